@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"github.com/crazi-coder/report-service/core/config"
+	"github.com/spf13/cobra"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration of the service",
+}
+
+// configPrintCmd prints the configuration read from the file, the environment and the flags.
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the effective configuration as YAML",
+	Long: `Prints the configuration the service would run with, read from the defaults, the
+configuration file, the environment and the flags. The configuration is not validated
+so an incomplete one can be inspected, use --redact before sharing the output.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := loadConfig(cmd)
+		if err != nil {
+			return err
+		}
+		if redact, _ := cmd.Flags().GetBool("redact"); redact {
+			conf = conf.Redacted()
+		}
+		out, err := conf.YAML()
+		if err != nil {
+			return err
+		}
+		_, err = cmd.OutOrStdout().Write(out)
+		return err
+	},
+}
+
+// loadConfig reads the configuration of the command, the flags are parsed by then.
+func loadConfig(cmd *cobra.Command) (*config.Config, error) {
+	// The errors past this point are about the configuration, not the usage of the command.
+	cmd.SilenceUsage = true
+	path, _ := cmd.Flags().GetString("config")
+	return config.Load(path, cmd.Flags())
+}
+
+func init() {
+	configPrintCmd.Flags().Bool("redact", false, "Replace the secrets which are set")
+	configCmd.AddCommand(configPrintCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -5,8 +5,11 @@ package cmd
 
 import (
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/crazi-coder/report-service/core"
+	"github.com/crazi-coder/report-service/core/config"
 	"github.com/spf13/cobra"
 )
 
@@ -22,12 +25,20 @@ This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
-	Run: func(cmd *cobra.Command, args []string) {
-		host, _ := cmd.Flags().GetString("host")
-		port, _ := cmd.Flags().GetString("port")
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := loadConfig(cmd)
+		if err != nil {
+			return err
+		}
+		if err := conf.ValidateServer(); err != nil {
+			return err
+		}
 
-		server := core.NewServer(cmd.Context(), host, port)
-		server.Start(cmd.Context())
+		// SIGTERM drains the requests and the running reports before exiting.
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		server := core.NewServer(ctx, conf)
+		return server.Start(ctx)
 	},
 }
 
@@ -41,6 +52,8 @@ func Execute() {
 }
 
 func init() {
-	rootCmd.PersistentFlags().String("host", "0.0.0.0", "The host address to listen on")
-	rootCmd.PersistentFlags().String("port", "3001", "The port to listen on")
+	rootCmd.PersistentFlags().String("config", "",
+		"The YAML or TOML configuration file, read from "+config.FileEnv+" when not given")
+	// Every setting but the secrets can be overridden on the command line, e.g. --host or --postgres-port.
+	config.BindFlags(rootCmd.PersistentFlags())
 }
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/crazi-coder/report-service/core"
+	"github.com/spf13/cobra"
+)
+
+// workerCmd represents the celery worker command
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "Consume the report generation tasks over the celery protocol",
+	Long: `Starts a celery worker which consumes the report generation tasks from the broker.
+The broker is configured by the celery and redis settings, tasks can be
+enqueued by this service or by the Django application using the same task name.
+
+The task is report.generate with the args (schema, report_id) and the optional
+request_id kwarg. Only the celery message protocol v1 is understood, the Python
+producers must publish with task_protocol=1 (CELERY_TASK_PROTOCOL = 1 in the
+Django settings).`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := loadConfig(cmd)
+		if err != nil {
+			return err
+		}
+		if err := conf.ValidateWorker(); err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		w := core.NewWorker(ctx, conf)
+		return w.Start(ctx)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(workerCmd)
+}
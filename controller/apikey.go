@@ -0,0 +1,306 @@
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crazi-coder/report-service/core/metrics"
+	"github.com/crazi-coder/report-service/core/middleware"
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/crazi-coder/report-service/core/tracing"
+	"github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// apiKeyCacheTTL is how long a verified API key is trusted without checking the database again. A revoked key
+// is only dropped from the cache of the replica serving the revocation, the other replicas accept it until their
+// cached entry expires, up to apiKeyCacheTTL after the revocation. Revoking every token of the owner takes effect
+// immediately on every replica, it is checked on each request.
+const apiKeyCacheTTL = time.Minute
+
+// apiKeyLastUsedInterval is the minimum interval between two writes of the last use of a key, the cached keys
+// in use are written at this interval too.
+const apiKeyLastUsedInterval = 10 * time.Second
+
+// apiKeyColumns are the auth_api_key columns read by scanAPIKey.
+var apiKeyColumns = []interface{}{"id", "name", "prefix", "scopes", "expires_at", "last_used", "revoked", "created"}
+
+type APIKeyController interface {
+	APIKeys(ctx context.Context, schema string, userID int64) ([]*APIKeyInfo, error)
+	CreateAPIKey(ctx context.Context, schema string, userID int64, request APIKeyRequest) (*APIKeyInfo, error)
+	RevokeAPIKey(ctx context.Context, schema string, userID int64, keyID int64) error
+	Verify(ctx context.Context, key string) (*middleware.APIKey, error)
+}
+
+type apiKeyCacheEntry struct {
+	key     *middleware.APIKey
+	expires time.Time
+	// used is the last use written to the database.
+	used time.Time
+}
+
+type apiKeyController struct {
+	conn    tracing.Querier
+	ctx     context.Context
+	logger  *logrus.Logger
+	dialect goqu.DialectWrapper
+	mu      sync.Mutex
+	cache   map[[sha256.Size]byte]apiKeyCacheEntry
+	tenants tenantLookup
+}
+
+func NewAPIKeyController(ctx context.Context, logger *logrus.Logger, conn *pgxpool.Pool,
+	tenants *tenant.Registry) APIKeyController {
+
+	return &apiKeyController{ctx: ctx, logger: logger, conn: tracing.WrapDB(conn), dialect: goqu.Dialect("postgres"),
+		cache: map[[sha256.Size]byte]apiKeyCacheEntry{}, tenants: tenants}
+}
+
+// APIKeys lists the API keys of the user, including the expired and revoked ones.
+func (a *apiKeyController) APIKeys(ctx context.Context, schema string, userID int64) ([]*APIKeyInfo, error) {
+	nq := a.dialect.From(goqu.S(schema).Table("auth_api_key")).Select(apiKeyColumns...).Where(
+		goqu.Ex{"user_id": userID},
+	).Order(goqu.I("id").Asc()).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	a.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	defer metrics.ObserveQuery("api_key", "api_keys")()
+	res, err := a.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	list := []*APIKeyInfo{}
+	for res.Next() {
+		k, err := scanAPIKey(res, tenant.SettingsFrom(ctx))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, k)
+	}
+	return list, res.Err()
+}
+
+// CreateAPIKey stores a new API key of the user, the key is of the form <schema>.<prefix>.<secret> and is
+// only returned here.
+func (a *apiKeyController) CreateAPIKey(ctx context.Context, schema string, userID int64, request APIKeyRequest) (*APIKeyInfo, error) {
+	prefix, err := randomToken(6, hex.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomToken(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := helpers.MakePassword(secret, "")
+	if err != nil {
+		return nil, err
+	}
+	scopes, err := json.Marshal(request.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	record := goqu.Record{
+		"user_id":  userID,
+		"name":     request.Name,
+		"prefix":   prefix,
+		"key_hash": hash,
+		"scopes":   string(scopes),
+	}
+	if request.ExpiresAt != nil {
+		record["expires_at"] = request.ExpiresAt.UTC()
+	}
+	iq := a.dialect.Insert(goqu.S(schema).Table("auth_api_key")).Rows(record).Returning(apiKeyColumns...).Prepared(true)
+	q, args, err := iq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	a.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "prefix": prefix}).Debug("Running ...")
+	k, err := scanAPIKey(a.conn.QueryRow(ctx, q, args...), tenant.SettingsFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	k.Key = strings.Join([]string{schema, prefix, secret}, ".")
+	return k, nil
+}
+
+// RevokeAPIKey revokes an API key of the user, the other replicas may accept it until their cache expires, see
+// apiKeyCacheTTL.
+func (a *apiKeyController) RevokeAPIKey(ctx context.Context, schema string, userID int64, keyID int64) error {
+	uq := a.dialect.Update(goqu.S(schema).Table("auth_api_key")).Set(
+		goqu.Record{"revoked": time.Now().UTC()},
+	).Where(goqu.Ex{"id": keyID, "user_id": userID, "revoked": nil}).Prepared(true)
+	q, args, err := uq.ToSQL()
+	if err != nil {
+		return err
+	}
+	a.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	tag, err := a.conn.Exec(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	a.mu.Lock()
+	for h, e := range a.cache {
+		if e.key.Schema == schema && e.key.ID == keyID {
+			delete(a.cache, h)
+		}
+	}
+	a.mu.Unlock()
+	return nil
+}
+
+// Verify returns the API key matching the key, helpers.ErrInvalidAPIKey is returned when it is unknown,
+// expired or revoked. The keys are cached, hashing the secret on every request would be too slow, the roles of
+// their owner are read again once the cached key expires.
+func (a *apiKeyController) Verify(ctx context.Context, key string) (*middleware.APIKey, error) {
+	sum := sha256.Sum256([]byte(key))
+	now := time.Now()
+	a.mu.Lock()
+	e, ok := a.cache[sum]
+	ok = ok && now.Before(e.expires)
+	touch := ok && now.Sub(e.used) >= apiKeyLastUsedInterval
+	if touch {
+		e.used = now
+		a.cache[sum] = e
+	}
+	a.mu.Unlock()
+	if ok {
+		if touch {
+			a.touch(ctx, e.key.Schema, e.key.ID, now)
+		}
+		return e.key, nil
+	}
+
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, helpers.ErrInvalidAPIKey
+	}
+	schema, prefix, secret := parts[0], parts[1], parts[2]
+	if _, ok := a.tenants.Lookup(ctx, schema); !ok {
+		return nil, helpers.ErrInvalidAPIKey
+	}
+	nq := a.dialect.From(goqu.S(schema).Table("auth_api_key")).Select(
+		"auth_api_key.id", "auth_api_key.user_id", "auth_api_key.key_hash", "auth_api_key.scopes",
+		"auth_api_key.expires_at", "auth_api_key.created", "auth_user.is_superuser",
+	).InnerJoin(goqu.S(schema).Table("auth_user"), goqu.On(goqu.Ex{
+		"auth_user.id": goqu.I("auth_api_key.user_id"),
+	})).Where(goqu.Ex{"auth_api_key.prefix": prefix, "auth_api_key.revoked": nil}).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		id, userID int64
+		hash       string
+		scopes     []byte
+		expiresAt  sql.NullTime
+		created    time.Time
+		superuser  bool
+	)
+	observe := metrics.ObserveQuery("api_key", "verify")
+	err = a.conn.QueryRow(ctx, q, args...).Scan(&id, &userID, &hash, &scopes, &expiresAt, &created, &superuser)
+	observe()
+	var pgErr *pgconn.PgError
+	switch {
+	case err == nil:
+	case errors.Is(err, pgx.ErrNoRows), errors.As(err, &pgErr) && pgErr.Code == pgUndefinedTable:
+		return nil, helpers.ErrInvalidAPIKey
+	default:
+		return nil, err
+	}
+	if ok, _ := helpers.CheckPassword(secret, hash); !ok || (expiresAt.Valid && !now.Before(expiresAt.Time)) {
+		return nil, helpers.ErrInvalidAPIKey
+	}
+	k := &middleware.APIKey{ID: id, Schema: schema, UserID: strconv.FormatInt(userID, 10), Scopes: []string{},
+		Created: created}
+	if err := json.Unmarshal(scopes, &k.Scopes); err != nil {
+		return nil, err
+	}
+	// The scopes were granted to the owner when the key was created, the owner may have lost them since.
+	if k.Roles, err = userRoles(ctx, a.conn, a.dialect, a.logger, schema, userID, superuser); err != nil {
+		return nil, err
+	}
+	a.touch(ctx, schema, id, now)
+
+	expires := now.Add(apiKeyCacheTTL)
+	if expiresAt.Valid && expiresAt.Time.Before(expires) {
+		expires = expiresAt.Time
+	}
+	a.mu.Lock()
+	for h, e := range a.cache {
+		if !now.Before(e.expires) {
+			delete(a.cache, h)
+		}
+	}
+	a.cache[sum] = apiKeyCacheEntry{key: k, expires: expires, used: now}
+	a.mu.Unlock()
+	return k, nil
+}
+
+// touch writes the last use of the key, a failure does not reject the request.
+func (a *apiKeyController) touch(ctx context.Context, schema string, id int64, now time.Time) {
+	uq := a.dialect.Update(goqu.S(schema).Table("auth_api_key")).Set(
+		goqu.Record{"last_used": now.UTC()},
+	).Where(goqu.Ex{"id": id}).Prepared(true)
+	q, args, err := uq.ToSQL()
+	if err == nil {
+		_, err = a.conn.Exec(ctx, q, args...)
+	}
+	if err != nil {
+		a.logger.WithContext(ctx).WithError(err).WithField("api_key_id", id).Error("Unable to update the API key last use")
+	}
+}
+
+// randomToken returns n random bytes from the system CSPRNG, encoded with encode.
+func randomToken(n int, encode func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
+
+func scanAPIKey(row pgx.Row, st tenant.Settings) (*APIKeyInfo, error) {
+	var (
+		k                            APIKeyInfo
+		scopes                       []byte
+		expiresAt, lastUsed, revoked sql.NullTime
+		created                      time.Time
+	)
+	if err := row.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &expiresAt, &lastUsed, &revoked, &created); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(scopes, &k.Scopes); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = st.Format(expiresAt.Time)
+	}
+	if lastUsed.Valid {
+		k.LastUsed = st.Format(lastUsed.Time)
+	}
+	if revoked.Valid {
+		k.Revoked = st.Format(revoked.Time)
+	}
+	k.Created = st.Format(created)
+	return &k, nil
+}
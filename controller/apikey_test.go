@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/doug-martin/goqu/v9"
+)
+
+const testAPIKey = "tenant_a.a1b2c3.s3cr3t"
+
+// apiKeyRow scans the auth_api_key row of testAPIKey, expiring at expiresAt unless it is zero.
+func apiKeyRow(t *testing.T, expiresAt time.Time) fakeRow {
+	t.Helper()
+	hash, err := helpers.MakePassword("s3cr3t", "")
+	if err != nil {
+		t.Fatalf("MakePassword: %v", err)
+	}
+	return func(dest ...interface{}) error {
+		*dest[0].(*int64) = 3
+		*dest[1].(*int64) = 7
+		*dest[2].(*string) = hash
+		*dest[3].(*[]byte) = []byte(`["sessions:view"]`)
+		*dest[4].(*sql.NullTime) = sql.NullTime{Time: expiresAt, Valid: !expiresAt.IsZero()}
+		*dest[5].(*time.Time) = time.Now().Add(-time.Hour)
+		*dest[6].(*bool) = false
+		return nil
+	}
+}
+
+func newTestAPIKeyController(row fakeRow) (*apiKeyController, *fakeDB) {
+	db := &fakeDB{row: row}
+	return &apiKeyController{ctx: context.Background(), logger: newTestLogger(), conn: db,
+		dialect: goqu.Dialect("postgres"), cache: map[[sha256.Size]byte]apiKeyCacheEntry{}, tenants: fakeTenants{}}, db
+}
+
+func TestVerifyAPIKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		key       string
+		expiresAt time.Time
+		ok        bool
+	}{
+		{"valid", testAPIKey, time.Time{}, true},
+		{"not expired yet", testAPIKey, time.Now().Add(time.Hour), true},
+		{"expired", testAPIKey, time.Now().Add(-time.Second), false},
+		{"wrong secret", "tenant_a.a1b2c3.wrong", time.Time{}, false},
+		{"unknown tenant", "tenant_b.a1b2c3.s3cr3t", time.Time{}, false},
+		{"malformed", "tenant_a.s3cr3t", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newTestAPIKeyController(apiKeyRow(t, tt.expiresAt))
+			k, err := a.Verify(context.Background(), tt.key)
+			if !tt.ok {
+				if !errors.Is(err, helpers.ErrInvalidAPIKey) {
+					t.Fatalf("Verify error = %v, want %v", err, helpers.ErrInvalidAPIKey)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if k.ID != 3 || k.Schema != "tenant_a" || k.UserID != "7" {
+				t.Errorf("key = %+v, want the key 3 of the user 7 of tenant_a", k)
+			}
+			// The scopes are returned along with the current roles of the owner, which restrict them.
+			if len(k.Scopes) != 1 || k.Scopes[0] != "sessions:view" || len(k.Roles) != 0 {
+				t.Errorf("scopes = %v, roles = %v, want [sessions:view] and no roles", k.Scopes, k.Roles)
+			}
+		})
+	}
+}
+
+// TestVerifyAPIKeyCacheExpiry checks that a cached key is not served after it expired.
+func TestVerifyAPIKeyCacheExpiry(t *testing.T) {
+	// Hashing is slow with -race, the key expires long enough after the first Verify.
+	expiresAt := time.Now().Add(2 * time.Second)
+	a, db := newTestAPIKeyController(apiKeyRow(t, expiresAt))
+	ctx := context.Background()
+	if _, err := a.Verify(ctx, testAPIKey); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	// The database is not read again while the key is cached.
+	db.setRow(func(dest ...interface{}) error { return errUnexpectedQuery })
+	if _, err := a.Verify(ctx, testAPIKey); err != nil {
+		t.Fatalf("Verify of the cached key: %v", err)
+	}
+
+	time.Sleep(time.Until(expiresAt))
+	db.setRow(apiKeyRow(t, expiresAt))
+	if _, err := a.Verify(ctx, testAPIKey); !errors.Is(err, helpers.ErrInvalidAPIKey) {
+		t.Errorf("Verify of the expired key error = %v, want %v", err, helpers.ErrInvalidAPIKey)
+	}
+}
+
+func TestVerifyAPIKeyLastUsed(t *testing.T) {
+	a, db := newTestAPIKeyController(apiKeyRow(t, time.Time{}))
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := a.Verify(ctx, testAPIKey); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	}
+	if n := db.execCount(); n != 1 {
+		t.Fatalf("last_used writes = %d, want 1 within apiKeyLastUsedInterval", n)
+	}
+
+	// The key is served from the cache, its use is still written once the interval passed.
+	sum := sha256.Sum256([]byte(testAPIKey))
+	a.mu.Lock()
+	e := a.cache[sum]
+	e.used = e.used.Add(-apiKeyLastUsedInterval)
+	a.cache[sum] = e
+	a.mu.Unlock()
+	db.setRow(func(dest ...interface{}) error { return errUnexpectedQuery })
+	if _, err := a.Verify(ctx, testAPIKey); err != nil {
+		t.Fatalf("Verify of the cached key: %v", err)
+	}
+	if n := db.execCount(); n != 2 {
+		t.Errorf("last_used writes = %d, want 2", n)
+	}
+}
@@ -0,0 +1,276 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/crazi-coder/report-service/core/metrics"
+	"github.com/crazi-coder/report-service/core/middleware"
+	"github.com/crazi-coder/report-service/core/revocation"
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/crazi-coder/report-service/core/tracing"
+	"github.com/crazi-coder/report-service/core/utils"
+	"github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// pgUndefinedTable is the PostgreSQL error code returned for the schemas without an auth_user table.
+const pgUndefinedTable = "42P01"
+
+type AuthController interface {
+	Issuing() bool
+	Token(ctx context.Context, schema string, username string, password string) (*TokenPair, error)
+	Refresh(ctx context.Context, refreshToken string) (*TokenPair, error)
+	Logout(ctx context.Context, schema string, userID string, tokenID string, expiresAt time.Time, refreshToken string) error
+	RevokeUser(ctx context.Context, schema string, userID string) error
+}
+
+// tenantLookup resolves the schema of a request to its tenant, it is implemented by the tenant.Registry.
+type tenantLookup interface {
+	Lookup(ctx context.Context, schema string) (*tenant.Tenant, bool)
+}
+
+type authController struct {
+	conn     tracing.Querier
+	ctx      context.Context
+	logger   *logrus.Logger
+	dialect  goqu.DialectWrapper
+	signer   *middleware.Signer
+	verifier *middleware.Verifier
+	revoked  revocation.Store
+	tenants  tenantLookup
+}
+
+// NewAuthController creates the auth controller, the signer is nil when the service does not issue tokens.
+func NewAuthController(ctx context.Context, logger *logrus.Logger, conn *pgxpool.Pool, signer *middleware.Signer,
+	verifier *middleware.Verifier, revoked revocation.Store, tenants *tenant.Registry) AuthController {
+
+	return &authController{ctx: ctx, logger: logger, conn: tracing.WrapDB(conn), dialect: goqu.Dialect("postgres"),
+		signer: signer, verifier: verifier, revoked: revoked, tenants: tenants}
+}
+
+// Issuing returns true if the service issues the tokens itself.
+func (a *authController) Issuing() bool {
+	return a.signer != nil
+}
+
+// Token checks the password of the user in the tenant schema and issues an access and refresh token pair.
+func (a *authController) Token(ctx context.Context, schema string, username string, password string) (*TokenPair, error) {
+	if _, ok := a.tenants.Lookup(ctx, schema); !ok {
+		// Hash anyway, so an unknown tenant takes as long as a wrong password.
+		helpers.MakePassword(password, "")
+		return nil, helpers.ErrInvalidCredentials
+	}
+	nq := a.dialect.From(goqu.S(schema).Table("auth_user")).Select("id", "password", "is_superuser").Where(
+		goqu.Ex{"username": username, "is_active": true},
+	).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		userID    int64
+		encoded   string
+		superuser bool
+	)
+	observe := metrics.ObserveQuery("auth", "user")
+	err = a.conn.QueryRow(ctx, q, args...).Scan(&userID, &encoded, &superuser)
+	observe()
+	var pgErr *pgconn.PgError
+	switch {
+	case err == nil:
+	case errors.Is(err, pgx.ErrNoRows), errors.As(err, &pgErr) && pgErr.Code == pgUndefinedTable:
+		// Hash anyway, so an unknown user takes as long as a wrong password.
+		helpers.MakePassword(password, "")
+		return nil, helpers.ErrInvalidCredentials
+	default:
+		return nil, err
+	}
+	ok, mustUpdate := helpers.CheckPassword(password, encoded)
+	if !ok {
+		return nil, helpers.ErrInvalidCredentials
+	}
+
+	record := goqu.Record{"last_login": time.Now().UTC()}
+	// Passwords of an older hasher or work factor are upgraded while the plain password is known.
+	if mustUpdate {
+		if encoded, err := helpers.MakePassword(password, ""); err != nil {
+			a.logger.WithContext(ctx).WithError(err).WithField("user_id", userID).Error("Unable to upgrade the password hash")
+		} else {
+			record["password"] = encoded
+		}
+	}
+	uq := a.dialect.Update(goqu.S(schema).Table("auth_user")).Set(
+		record,
+	).Where(goqu.Ex{"id": userID}).Prepared(true)
+	q, args, err = uq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := a.conn.Exec(ctx, q, args...); err != nil {
+		return nil, err
+	}
+	return a.tokenPair(ctx, schema, userID, superuser)
+}
+
+// Refresh rotates the refresh token, the token is revoked and a new token pair is issued. A refresh token
+// used twice was stolen or leaked, every token of the user is then revoked.
+func (a *authController) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	claims, err := a.refreshClaims(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := a.tenants.Lookup(ctx, claims.Schema); !ok {
+		return nil, helpers.ErrInvalidToken
+	}
+	revoked, err := a.revoked.IsRevoked(ctx, claims.Schema, claims.UserID, claims.ID, claims.IssuedAt.Time)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, a.reused(ctx, claims)
+	}
+
+	// The user may have been deactivated since the login.
+	nq := a.dialect.From(goqu.S(claims.Schema).Table("auth_user")).Select("id", "is_superuser").Where(
+		goqu.Ex{"id": claims.UserID, "is_active": true},
+	).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		userID    int64
+		superuser bool
+	)
+	switch err := a.conn.QueryRow(ctx, q, args...).Scan(&userID, &superuser); err {
+	case nil:
+	case pgx.ErrNoRows:
+		return nil, helpers.ErrInvalidToken
+	default:
+		return nil, err
+	}
+	// The check above does not stop concurrent rotations of the token, only one of them revokes it.
+	claimed, err := a.revoked.Revoke(ctx, claims.Schema, claims.UserID, claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, a.reused(ctx, claims)
+	}
+	return a.tokenPair(ctx, claims.Schema, userID, superuser)
+}
+
+// reused revokes every token of the user whose refresh token was used twice.
+func (a *authController) reused(ctx context.Context, claims *middleware.JWTClaims) error {
+	a.logger.WithContext(ctx).WithFields(logrus.Fields{"schema": claims.Schema, "user_id": claims.UserID}).Warn(
+		"Revoked refresh token reused, revoking every token of the user")
+	if err := a.revoked.RevokeUser(ctx, claims.Schema, claims.UserID); err != nil {
+		return err
+	}
+	return helpers.ErrInvalidToken
+}
+
+// Logout revokes the access token of the request and the refresh token of the same user, if given.
+func (a *authController) Logout(ctx context.Context, schema string, userID string, tokenID string, expiresAt time.Time,
+	refreshToken string) error {
+
+	if refreshToken != "" {
+		claims, err := a.refreshClaims(refreshToken)
+		if err != nil {
+			return err
+		}
+		if claims.Schema != schema || claims.UserID != userID {
+			return helpers.ErrInvalidToken
+		}
+		if _, err := a.revoked.Revoke(ctx, schema, userID, claims.ID, claims.ExpiresAt.Time); err != nil {
+			return err
+		}
+	}
+	_, err := a.revoked.Revoke(ctx, schema, userID, tokenID, expiresAt)
+	return err
+}
+
+// RevokeUser revokes every token issued to the user until now.
+func (a *authController) RevokeUser(ctx context.Context, schema string, userID string) error {
+	return a.revoked.RevokeUser(ctx, schema, userID)
+}
+
+// refreshClaims validates the refresh token and returns its claims.
+func (a *authController) refreshClaims(refreshToken string) (*middleware.JWTClaims, error) {
+	claims, err := a.verifier.ParseToken(refreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", helpers.ErrInvalidToken, err)
+	}
+	if claims.TokenType != middleware.TokenRefresh || claims.ID == "" || claims.IssuedAt == nil {
+		return nil, helpers.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// userRoles returns the django group names of the user, along with the admin role of the superusers. They are
+// the roles of the tokens and the roles the API keys of the user are restricted to.
+func userRoles(ctx context.Context, conn tracing.Querier, dialect goqu.DialectWrapper, logger *logrus.Logger,
+	schema string, userID int64, superuser bool) ([]string, error) {
+
+	nq := dialect.From(goqu.S(schema).Table("auth_group")).Select("auth_group.name").InnerJoin(
+		goqu.S(schema).Table("auth_user_groups"), goqu.On(goqu.Ex{
+			"auth_user_groups.group_id": goqu.I("auth_group.id"),
+		}),
+	).Where(goqu.Ex{"auth_user_groups.user_id": userID}).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	defer metrics.ObserveQuery("auth", "roles")()
+	res, err := conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	roles := []string{}
+	for res.Next() {
+		var role string
+		if err := res.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if superuser {
+		roles = append(roles, utils.RoleAdmin)
+	}
+	return roles, res.Err()
+}
+
+// tokenPair issues an access and a refresh token for the user, the roles are read again on every issue.
+func (a *authController) tokenPair(ctx context.Context, schema string, uid int64, superuser bool) (*TokenPair, error) {
+	roles, err := userRoles(ctx, a.conn, a.dialect, a.logger, schema, uid, superuser)
+	if err != nil {
+		return nil, err
+	}
+	userID := strconv.FormatInt(uid, 10)
+	access, accessClaims, err := a.signer.CreateToken(ctx, userID, roles, schema, middleware.TokenAccess)
+	if err != nil {
+		return nil, err
+	}
+	refresh, refreshClaims, err := a.signer.CreateToken(ctx, userID, roles, schema, middleware.TokenRefresh)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &TokenPair{
+		AccessToken:      access,
+		RefreshToken:     refresh,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(accessClaims.ExpiresAt.Sub(now).Seconds()),
+		RefreshExpiresIn: int64(refreshClaims.ExpiresAt.Sub(now).Seconds()),
+	}, nil
+}
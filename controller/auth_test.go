@@ -0,0 +1,277 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crazi-coder/report-service/core/middleware"
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/crazi-coder/report-service/core/tracing"
+	"github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// errUnexpectedQuery is returned by fakeDB for the calls the tests do not expect.
+var errUnexpectedQuery = errors.New("unexpected query")
+
+// fakeDB answers every QueryRow with row and every Query with no rows, the users have no groups. The Exec calls
+// are counted.
+type fakeDB struct {
+	tracing.Querier
+	row   fakeRow
+	mu    sync.Mutex
+	execs int
+}
+
+func (db *fakeDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.row == nil {
+		return fakeRow(func(dest ...interface{}) error { return errUnexpectedQuery })
+	}
+	return db.row
+}
+
+func (db *fakeDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return &fakeRows{}, nil
+}
+
+func (db *fakeDB) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.execs++
+	return pgconn.CommandTag("UPDATE 1"), nil
+}
+
+func (db *fakeDB) setRow(row fakeRow) {
+	db.mu.Lock()
+	db.row = row
+	db.mu.Unlock()
+}
+
+func (db *fakeDB) execCount() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.execs
+}
+
+// fakeRow is a pgx.Row scanning the values set by the function.
+type fakeRow func(dest ...interface{}) error
+
+func (r fakeRow) Scan(dest ...interface{}) error {
+	return r(dest...)
+}
+
+// activeUser scans the id and is_superuser of the active user 7.
+func activeUser(dest ...interface{}) error {
+	*dest[0].(*int64) = 7
+	*dest[1].(*bool) = false
+	return nil
+}
+
+// fakeRows is an empty result, the methods not used by the controllers are left to the nil pgx.Rows.
+type fakeRows struct {
+	pgx.Rows
+}
+
+func (*fakeRows) Next() bool                     { return false }
+func (*fakeRows) Scan(dest ...interface{}) error { return errUnexpectedQuery }
+func (*fakeRows) Err() error                     { return nil }
+func (*fakeRows) Close()                         {}
+
+// memStore is an in-memory revocation.Store with the semantics of the PostgreSQL one: a jti is claimed once and
+// the user revocations are truncated to the second, as the iat of the tokens.
+type memStore struct {
+	mu          sync.Mutex
+	jtis        map[string]bool
+	users       map[string]time.Time
+	userRevoked int
+}
+
+func newMemStore() *memStore {
+	return &memStore{jtis: map[string]bool{}, users: map[string]time.Time{}}
+}
+
+func (s *memStore) Revoke(ctx context.Context, schema string, userID string, jti string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jtis[schema+":"+jti] {
+		return false, nil
+	}
+	s.jtis[schema+":"+jti] = true
+	return true, nil
+}
+
+func (s *memStore) RevokeUser(ctx context.Context, schema string, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[schema+":"+userID] = time.Now().Truncate(time.Second)
+	s.userRevoked++
+	return nil
+}
+
+func (s *memStore) IsRevoked(ctx context.Context, schema string, userID string, jti string, issuedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jtis[schema+":"+jti] {
+		return true, nil
+	}
+	before, ok := s.users[schema+":"+userID]
+	return ok && !issuedAt.After(before), nil
+}
+
+func (s *memStore) Purge(ctx context.Context, schemas []string) error {
+	return nil
+}
+
+// fakeTenants knows tenant_a only.
+type fakeTenants struct{}
+
+func (fakeTenants) Lookup(ctx context.Context, schema string) (*tenant.Tenant, bool) {
+	if schema != "tenant_a" {
+		return nil, false
+	}
+	return &tenant.Tenant{Schema: schema}, true
+}
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func newTestAuthController(t *testing.T) (*authController, *memStore) {
+	t.Helper()
+	logger := newTestLogger()
+	secret := []byte("shared secret")
+	signer, err := middleware.NewSigner(middleware.SignerConfig{Secret: secret, AccessTTL: time.Minute,
+		RefreshTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	verifier, err := middleware.NewVerifier(context.Background(), logger, middleware.VerifierConfig{Secret: secret})
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	store := newMemStore()
+	return &authController{ctx: context.Background(), logger: logger, conn: &fakeDB{row: activeUser},
+		dialect: goqu.Dialect("postgres"),
+		signer:  signer, verifier: verifier, revoked: store, tenants: fakeTenants{}}, store
+}
+
+// isRevoked reports whether the token is rejected by the revocation checks of the middleware.
+func isRevoked(t *testing.T, a *authController, token string) bool {
+	t.Helper()
+	claims, err := a.verifier.ParseToken(token)
+	if err != nil {
+		t.Fatalf("ParseToken: %v", err)
+	}
+	revoked, err := a.revoked.IsRevoked(context.Background(), claims.Schema, claims.UserID, claims.ID,
+		claims.IssuedAt.Time)
+	if err != nil {
+		t.Fatalf("IsRevoked: %v", err)
+	}
+	return revoked
+}
+
+func TestRefreshReuse(t *testing.T) {
+	a, store := newTestAuthController(t)
+	ctx := context.Background()
+	login, err := a.tokenPair(ctx, "tenant_a", 7, false)
+	if err != nil {
+		t.Fatalf("tokenPair: %v", err)
+	}
+
+	rotated, err := a.Refresh(ctx, login.RefreshToken)
+	if err != nil {
+		t.Fatalf("first Refresh: %v", err)
+	}
+	if !isRevoked(t, a, login.RefreshToken) {
+		t.Error("the rotated refresh token is not revoked")
+	}
+	if isRevoked(t, a, rotated.AccessToken) || isRevoked(t, a, rotated.RefreshToken) {
+		t.Fatal("the new token pair is revoked")
+	}
+
+	if _, err := a.Refresh(ctx, login.RefreshToken); !errors.Is(err, helpers.ErrInvalidToken) {
+		t.Fatalf("second Refresh error = %v, want %v", err, helpers.ErrInvalidToken)
+	}
+	if store.userRevoked != 1 {
+		t.Errorf("RevokeUser calls = %d, want 1", store.userRevoked)
+	}
+	// The pair issued by the first refresh may be the stolen one, it is revoked along with the others.
+	for name, token := range map[string]string{
+		"login access":    login.AccessToken,
+		"rotated access":  rotated.AccessToken,
+		"rotated refresh": rotated.RefreshToken,
+	} {
+		if !isRevoked(t, a, token) {
+			t.Errorf("the %s token is not revoked", name)
+		}
+	}
+	if _, err := a.Refresh(ctx, rotated.RefreshToken); !errors.Is(err, helpers.ErrInvalidToken) {
+		t.Errorf("Refresh of the rotated token error = %v, want %v", err, helpers.ErrInvalidToken)
+	}
+}
+
+// TestRefreshConcurrent is meant for -race: only one of the concurrent rotations of a token succeeds.
+func TestRefreshConcurrent(t *testing.T) {
+	a, store := newTestAuthController(t)
+	login, err := a.tokenPair(context.Background(), "tenant_a", 7, false)
+	if err != nil {
+		t.Fatalf("tokenPair: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := a.Refresh(context.Background(), login.RefreshToken)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, helpers.ErrInvalidToken):
+			t.Errorf("Refresh: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d refreshes succeeded, want 1", succeeded)
+	}
+	if store.userRevoked == 0 {
+		t.Error("the user was not revoked on the reuse")
+	}
+}
+
+func TestRefreshInvalid(t *testing.T) {
+	a, _ := newTestAuthController(t)
+	ctx := context.Background()
+	access, _, err := a.signer.CreateToken(ctx, "7", nil, "tenant_a", middleware.TokenAccess)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	unknown, _, err := a.signer.CreateToken(ctx, "7", nil, "tenant_b", middleware.TokenRefresh)
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	for name, token := range map[string]string{"access token": access, "unknown tenant": unknown, "garbage": "x.y.z"} {
+		if _, err := a.Refresh(ctx, token); !errors.Is(err, helpers.ErrInvalidToken) {
+			t.Errorf("Refresh of the %s error = %v, want %v", name, err, helpers.ErrInvalidToken)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package controller
 
+import "time"
+
 const (
 	// Unknown is the default unknown message
 	Unknown = "unknown"
@@ -11,4 +13,66 @@ const (
 	InvalidPageNumber = "invalid page number"
 	//Unrecognized will be the default error message
 	Unrecognized = "unrecognized error"
+	// ReportNotReady is returned when the report file is requested before the run completed
+	ReportNotReady = "report is not ready"
+	// InvalidReportStatus is returned when the report can not be cancelled or retried in its current status
+	InvalidReportStatus = "report status does not allow this operation"
+	// InvalidSchedule is returned when the cron expression, timezone or window of a schedule is not valid
+	InvalidSchedule = "invalid schedule"
+	// InvalidScopes is returned when an API key is requested with unknown scopes or scopes the user is not granted
+	InvalidScopes = "invalid scopes"
+	// ReportInterrupted is the history message of the reports queued again after a shutdown interrupted them
+	ReportInterrupted = "interrupted by a shutdown, queued again"
+	// ReportAbandoned is the history message of the reports queued again after their worker stopped without
+	// finishing them
+	ReportAbandoned = "abandoned by its worker, queued again"
+)
+
+const (
+	// StatusQueued is set when the report run is accepted and waiting for a worker
+	StatusQueued = "queued"
+	// StatusRunning is set once a worker picked up the report run
+	StatusRunning = "running"
+	// StatusCompleted is set when the report was generated successfully
+	StatusCompleted = "completed"
+	// StatusFailed is set when the report generation returned an error
+	StatusFailed = "failed"
+	// StatusCancelled is set when the user cancelled a queued or running report
+	StatusCancelled = "cancelled"
+)
+
+const (
+	// ContentTypeXLSX is the content type of the generated report workbooks
+	ContentTypeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	// SignedURLExpiry is the validity of the signed URLs handed out for the report files
+	SignedURLExpiry = 15 * time.Minute
+	// runHeartbeat is the interval the workers refresh the heartbeat of their run and check it was not cancelled
+	runHeartbeat = 5 * time.Second
+	// staleRun is the age of the heartbeat after which the worker of a run is considered gone, e.g. killed
+	staleRun = 12 * runHeartbeat
+	// RecoverInterval is the interval the server looks for the runs abandoned by their worker
+	RecoverInterval = time.Minute
+	// watchResync is the interval the watched reports read their status again, in case an event was missed
+	watchResync = 15 * time.Second
+	// requeueTimeout bounds the update queuing an interrupted report again, the job context is done by then
+	requeueTimeout = 10 * time.Second
+)
+
+// exportBatchSize is the number of rows fetched from the cursor at once while exporting.
+const exportBatchSize = 1000
+
+const (
+	// ReportTypePhotoSession is the report_type name of the photo session report
+	ReportTypePhotoSession = "photo_session"
+)
+
+const (
+	// WindowToday covers the day of the scheduled run
+	WindowToday = "today"
+	// WindowYesterday covers the day before the scheduled run
+	WindowYesterday = "yesterday"
+	// WindowLastWeek covers the previous week, starting on the week start of the tenant
+	WindowLastWeek = "last_week"
+	// WindowLastMonth covers the previous calendar month
+	WindowLastMonth = "last_month"
 )
@@ -1,6 +1,9 @@
 package controller
 
 import (
+	"database/sql"
+	"encoding/json"
+	"io"
 	"net/url"
 	"strconv"
 	"strings"
@@ -24,6 +27,14 @@ type Request struct {
 	QualityProcessionStatus string    `json:"quality_processing_status"`
 	PageSize                uint      `json:"page_size"`
 	PageNumber              uint      `json:"page_number"`
+	// ScopeUserID restricts the stores and users to the ones visible to this user, it is always set
+	// by the controller for the users who can not see every store.
+	ScopeUserID int64 `json:"scope_user_id,omitempty"`
+	// Timezone is the timezone of the dates written in the workbook, the one of the tenant by default.
+	Timezone string `json:"timezone,omitempty"`
+	// Trace is the trace context of the request queuing the report, the worker continues the trace.
+	// It is always set by the controller.
+	Trace map[string]string `json:"trace,omitempty"`
 }
 
 func (r *Request) SetPageSize(pageSize string) {
@@ -95,13 +106,62 @@ func (r *Request) PhotoTypeList(photoTypeStr string) {
 
 }
 
+// RunRequest is the payload used to start a new report run.
+type RunRequest struct {
+	ReportType string `json:"report_type"`
+	Request
+}
+
+// DownloadFilter filters the report run history.
+type DownloadFilter struct {
+	// AllUsers lists the runs of every user instead of the requesting user, UserID narrows it to one user.
+	AllUsers    bool
+	UserID      int64
+	Status      []string
+	ReportType  []string
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	PageSize    uint
+	PageNumber  uint
+}
+
 type Download struct {
 	ID         int64  `json:"id"`
+	UserID     int64  `json:"user_id,omitempty"`
 	ReportName string `json:"report_name"`
 	Status     string `json:"status"`
+	FileName   string `json:"file_name,omitempty"`
+	FileSize   int64  `json:"file_size,omitempty"`
 	Created    string `json:"created"`
 	Modified   string `json:"modified"`
 }
+
+// DownloadStatus is a status change of a report run.
+type DownloadStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	Created string `json:"created"`
+}
+
+// DownloadDetail is a report run along with its filter payload and status history.
+type DownloadDetail struct {
+	Download
+	ErrorMessage string            `json:"error_message,omitempty"`
+	RowCount     int64             `json:"row_count"`
+	Progress     int               `json:"progress"`
+	Request      json.RawMessage   `json:"request,omitempty"`
+	History      []*DownloadStatus `json:"history"`
+}
+
+// Artifact is the generated file of a report run, either URL or Body is set.
+type Artifact struct {
+	FileName    string
+	ContentType string
+	Size        int64
+	URL         string
+	Body        io.ReadCloser
+}
+
 type Store struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
@@ -143,6 +203,10 @@ type PhotoSession struct {
 	SessionProcessingStatus string    `json:"session_processing_status"`
 	EvidenceProgressStatus  string    `json:"evidence_progress_status"`
 	QualityProcessionStatus string    `json:"quality_processing_status"`
+
+	// createdOn and visitedOn keep the typed timestamps for the report workbooks.
+	createdOn time.Time
+	visitedOn sql.NullTime
 }
 
 // Paginator is a  Generic Type used for pagination.
@@ -154,7 +218,7 @@ type Paginator struct {
 // Pagination implementation for pagination.
 func (p *Paginator) Pagination(requestURL string, requestedPageNumber uint,
 	itemPerPage uint, totalItem uint) (*Paginator, error) {
-	if (totalItem/itemPerPage+1 <= requestedPageNumber) {
+	if totalItem/itemPerPage+1 <= requestedPageNumber {
 		return nil, helpers.ErrPageLimitExceeded
 	}
 	var nextPageNumber uint
@@ -209,7 +273,79 @@ func (p *Paginator) Pagination(requestURL string, requestedPageNumber uint,
 
 // PaginatedResult stores the search results after the search run.
 type PaginatedResult struct {
-	Count     uint         `json:"count"`
+	Count     uint        `json:"count"`
 	Paginator Paginator   `json:"pagination"`
 	Result    interface{} `json:"results"`
 }
+
+// ScheduleRequest is the payload used to create or update a report schedule.
+type ScheduleRequest struct {
+	Name       string `json:"name"`
+	ReportType string `json:"report_type"`
+	// Cron is a standard 5 field cron expression evaluated in the Timezone.
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone"`
+	// Window replaces the visited range of the request on every run, e.g. "last_7_days" or "last_month".
+	Window   string  `json:"window"`
+	IsActive *bool   `json:"is_active"`
+	Request  Request `json:"request"`
+}
+
+// Schedule is a recurring report run.
+type Schedule struct {
+	ID           int64   `json:"id"`
+	Name         string  `json:"name"`
+	ReportType   string  `json:"report_type"`
+	Cron         string  `json:"cron"`
+	Timezone     string  `json:"timezone"`
+	Window       string  `json:"window"`
+	IsActive     bool    `json:"is_active"`
+	Request      Request `json:"request"`
+	NextRun      string  `json:"next_run,omitempty"`
+	LastRun      string  `json:"last_run,omitempty"`
+	LastReportID int64   `json:"last_report_id,omitempty"`
+	LastError    string  `json:"last_error,omitempty"`
+	Created      string  `json:"created"`
+	Modified     string  `json:"modified"`
+}
+
+// TokenRequest is the payload used to log in, Tenant is the schema of the user.
+type TokenRequest struct {
+	Tenant   string `json:"tenant" binding:"required"`
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// TokenPair is the access and refresh token issued on login.
+type TokenPair struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+// RefreshRequest is the payload used to rotate a refresh token, or to revoke it on logout.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// APIKeyRequest is the payload used to create an API key, the key never expires without ExpiresAt.
+type APIKeyRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// APIKeyInfo describes an API key, Key is only returned once on creation.
+type APIKeyInfo struct {
+	ID        int64    `json:"id"`
+	Name      string   `json:"name"`
+	Prefix    string   `json:"prefix"`
+	Key       string   `json:"key,omitempty"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt string   `json:"expires_at,omitempty"`
+	LastUsed  string   `json:"last_used,omitempty"`
+	Revoked   string   `json:"revoked,omitempty"`
+	Created   string   `json:"created"`
+}
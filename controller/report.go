@@ -3,56 +3,608 @@ package controller
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path"
 	"time"
 
+	"github.com/crazi-coder/report-service/core/events"
+	"github.com/crazi-coder/report-service/core/logging"
+	"github.com/crazi-coder/report-service/core/metrics"
+	"github.com/crazi-coder/report-service/core/storage"
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/crazi-coder/report-service/core/tracing"
+	"github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/crazi-coder/report-service/core/worker"
 	"github.com/doug-martin/goqu/v9"
 	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	_ "github.com/doug-martin/goqu/v9/dialect/postgres"
 )
 
 type ReportController interface {
-	Run(ctx context.Context, schema string, userID int64, request Request) (*PhotoSession, error)
-	Download(ctx context.Context, schema string, userID int64, request Request) ([]*Download, error)
+	Run(ctx context.Context, schema string, userID int64, reportType string, request Request) (*Download, error)
+	Execute(ctx context.Context, job worker.Job) error
+	Requeue(ctx context.Context, schemas []string) error
+	Recover(ctx context.Context, schemas []string) error
+	Download(ctx context.Context, schema string, userID int64, url string, filter DownloadFilter) (*PaginatedResult, error)
 	StoreChannel(ctx context.Context, schema string, userID int64, request Request) ([]*StoreChannel, error)
 	StoreBrand(ctx context.Context, schema string, userID int64, request Request) ([]*StoreBrand, error)
 	Store(ctx context.Context, schema string, userID int64, request Request) ([]*Store, error)
 	Category(ctx context.Context, schema string, userID int64, request Request) ([]*Category, error)
 	Users(ctx context.Context, schema string, userID int64, request Request) ([]*User, error)
 	PhotoTypes(ctx context.Context, schema string, userID int64, request Request) ([]*PhotoType, error)
+	DownloadArtifact(ctx context.Context, schema string, userID int64, reportID int64) (*Artifact, error)
+	DownloadDetail(ctx context.Context, schema string, userID int64, reportID int64) (*DownloadDetail, error)
+	CancelDownload(ctx context.Context, schema string, userID int64, reportID int64) (*DownloadDetail, error)
+	RetryDownload(ctx context.Context, schema string, userID int64, reportID int64) (*DownloadDetail, error)
+	WatchDownload(ctx context.Context, schema string, userID int64, reportID int64) (<-chan events.Event, error)
 	PhotoSessions(ctx context.Context, schema string, userID int64, url string, request Request) (*PaginatedResult, error)
+	ExportPhotoSessions(ctx context.Context, schema string, userID int64, request Request, fn func(*PhotoSession) error) error
 }
 
 type reportController struct {
-	conn    *pgxpool.Pool
+	conn    tracing.Querier
 	ctx     context.Context
 	logger  *logrus.Logger
 	tenant  exp.IdentifierExpression
 	dialect goqu.DialectWrapper
+	queue   worker.Queue
+	store   storage.BlobStore
+	events  events.Bus
 }
 
-func NewReportController(ctx context.Context, logger *logrus.Logger, conn *pgxpool.Pool) ReportController {
+func NewReportController(ctx context.Context, logger *logrus.Logger, conn *pgxpool.Pool, queue worker.Queue,
+	store storage.BlobStore, bus events.Bus) ReportController {
 
-	return &reportController{ctx: ctx, logger: logger, conn: conn, dialect: goqu.Dialect("postgres")}
+	return &reportController{ctx: ctx, logger: logger, conn: tracing.WrapDB(conn), dialect: goqu.Dialect("postgres"),
+		queue: queue, store: store, events: bus}
 }
 
-func (r *reportController) Run(ctx context.Context, schema string, userID int64, request Request) (*PhotoSession, error) {
+// Run creates a queued download_report row for the given report type and hands it over to the worker queue.
+func (r *reportController) Run(ctx context.Context, schema string, userID int64, reportType string, request Request) (*Download, error) {
+	tblDownloadReport := goqu.S(schema).Table("download_report")
+	tblReportModelMap := goqu.S(schema).Table("report_model_map")
+	tblReportType := goqu.S(schema).Table("report_type")
+
+	mq := r.dialect.From(tblReportModelMap).Select("report_model_map.id").InnerJoin(
+		tblReportType, goqu.On(goqu.Ex{
+			"report_model_map.report_type_id": goqu.I("report_type.id"),
+		}),
+	).Where(goqu.Ex{"report_type.name": reportType}).Limit(1).Prepared(true)
+	q, args, err := mq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	var reportMapID int64
+	err = r.conn.QueryRow(ctx, q, args...).Scan(&reportMapID)
+	switch err {
+	case nil:
+	case pgx.ErrNoRows:
+		return nil, helpers.ErrReportTypeNotFound
+	default:
+		return nil, err
+	}
+
+	scopeRequest(ctx, userID, &request)
+	// The workbook is written by a worker, it keeps the timezone of the request.
+	if request.Timezone == "" {
+		request.Timezone = tenant.SettingsFrom(ctx).Timezone
+	}
+	request.Trace = tracing.Inject(ctx)
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	iq := r.dialect.Insert(tblDownloadReport).Rows(goqu.Record{
+		"report_map_id": reportMapID,
+		"user_id":       userID,
+		"status":        StatusQueued,
+		"request":       string(payload),
+		"created":       now,
+		"modified":      now,
+	}).Returning("id").Prepared(true)
+	q, args, err = iq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	st := tenant.SettingsFrom(ctx)
+	d := Download{ReportName: reportType, Status: StatusQueued, Created: st.Format(now), Modified: st.Format(now)}
+	tx, err := r.conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	if err := tx.QueryRow(ctx, q, args...).Scan(&d.ID); err != nil {
+		return nil, err
+	}
+	if err := r.addHistory(ctx, tx, schema, d.ID, StatusQueued, "", now); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
 
-	return nil, nil
+	if err := r.enqueue(ctx, schema, d.ID); err != nil {
+		return nil, err
+	}
+	return &d, nil
 }
 
-func (r *reportController) Download(ctx context.Context, schema string, userID int64, request Request) ([]*Download, error) {
+// enqueue hands the queued report over to the workers, the report is marked as failed if that is not possible.
+func (r *reportController) enqueue(ctx context.Context, schema string, reportID int64) error {
+	err := r.queue.Enqueue(ctx, worker.Job{ReportID: reportID, Schema: schema, RequestID: logging.RequestID(ctx)})
+	if err != nil {
+		r.logger.WithContext(ctx).WithError(err).WithField("report_id", reportID).Error("Unable to enqueue the report")
+		_, e := r.transition(ctx, schema, reportID, inStatus(StatusQueued), StatusFailed, err.Error(),
+			goqu.Record{"error_message": err.Error()})
+		if e != nil {
+			r.logger.WithContext(ctx).WithError(e).Error("Unable to mark the report as failed")
+		}
+	}
+	return err
+}
+
+// Execute generates the report for the given job, moving it from running to completed or failed.
+func (r *reportController) Execute(ctx context.Context, job worker.Job) (err error) {
+	if job.RequestID != "" {
+		ctx = logging.WithRequestID(ctx, job.RequestID)
+	}
+	outcome := metrics.OutcomeFailed
+	defer func() { metrics.ReportJobs.WithLabelValues(outcome).Inc() }()
+	tblDownloadReport := goqu.S(job.Schema).Table("download_report")
+	tblReportModelMap := goqu.S(job.Schema).Table("report_model_map")
+	tblReportType := goqu.S(job.Schema).Table("report_type")
+
+	nq := r.dialect.From(tblDownloadReport).Select(
+		"report_type.name", "download_report.request", "download_report.attempt",
+	).InnerJoin(
+		tblReportModelMap, goqu.On(goqu.Ex{
+			"report_model_map.id": goqu.I("download_report.report_map_id"),
+		}),
+	).InnerJoin(
+		tblReportType, goqu.On(goqu.Ex{
+			"report_model_map.report_type_id": goqu.I("report_type.id"),
+		}),
+	).Where(goqu.Ex{"download_report.id": job.ReportID}).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return err
+	}
+	var (
+		reportType string
+		payload    []byte
+		attempt    int
+	)
+	if err := r.conn.QueryRow(ctx, q, args...).Scan(&reportType, &payload, &attempt); err != nil {
+		return err
+	}
+	// The job span continues the trace of the request queuing the report.
+	stored := struct {
+		Trace map[string]string `json:"trace"`
+	}{}
+	_ = json.Unmarshal(payload, &stored)
+	ctx, span := tracing.Tracer().Start(tracing.Extract(ctx, stored.Trace), "report.execute",
+		trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+			attribute.Int64("report.id", job.ReportID), attribute.String("report.type", reportType),
+			attribute.String("tenant.schema", job.Schema),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	log := r.logger.WithContext(ctx).WithFields(logrus.Fields{"report_id": job.ReportID, "schema": job.Schema})
+	// Starting the run claims the next attempt, only one of the workers given the same report gets it.
+	ok, err := r.transition(ctx, job.Schema, job.ReportID, inRun(attempt, StatusQueued), StatusRunning, "",
+		goqu.Record{"attempt": attempt + 1, "heartbeat": goqu.L("now()"), "progress": 0})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// The report was cancelled or picked up by another worker in the meantime.
+		log.Info("Report is no longer queued, skipping")
+		outcome = metrics.OutcomeSkipped
+		return nil
+	}
+	attempt++
+
+	runCtx, stop := r.watchRun(ctx, job.Schema, job.ReportID, attempt)
+	record, err := r.generate(runCtx, job, attempt, reportType, payload)
+	if stop() {
+		log.Info("Report was cancelled while running, stopping")
+		outcome = metrics.OutcomeCancelled
+		return r.release(ctx, job, attempt, record)
+	}
+	if err != nil && ctx.Err() != nil {
+		// The worker is shutting down, the report is queued again instead of failing.
+		log.WithError(err).Warn("Report interrupted, queuing it again")
+		outcome = metrics.OutcomeRequeued
+		return r.requeue(ctx, job, attempt)
+	}
+	if err != nil {
+		_, e := r.transition(ctx, job.Schema, job.ReportID, inRun(attempt, StatusRunning), StatusFailed, err.Error(),
+			goqu.Record{"error_message": err.Error(), "heartbeat": nil})
+		if e != nil {
+			log.WithError(e).Error("Unable to mark the report as failed")
+		}
+		return err
+	}
+	record["error_message"] = nil
+	record["heartbeat"] = nil
+	ok, err = r.transition(ctx, job.Schema, job.ReportID, inRun(attempt, StatusRunning), StatusCompleted, "", record)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Info("Report was cancelled while running, removing the generated file")
+		outcome = metrics.OutcomeCancelled
+		return r.release(ctx, job, attempt, record)
+	}
+	outcome = metrics.OutcomeCompleted
+	return nil
+}
+
+// watchRun refreshes the heartbeat of the run until the returned stop function is called. The returned context
+// is cancelled once the run is no longer running under the attempt, e.g. cancelled by the user, stop then
+// returns true.
+func (r *reportController) watchRun(ctx context.Context, schema string, reportID int64, attempt int) (context.Context, func() bool) {
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	cancelled := false
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(runHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			active, err := r.beat(runCtx, schema, reportID, attempt)
+			if err != nil {
+				if runCtx.Err() == nil {
+					r.logger.WithContext(ctx).WithError(err).WithField("report_id", reportID).Warn(
+						"Unable to refresh the report heartbeat")
+				}
+				continue
+			}
+			if !active {
+				cancelled = true
+				cancel()
+				return
+			}
+		}
+	}()
+	return runCtx, func() bool {
+		cancel()
+		<-done
+		return cancelled
+	}
+}
+
+// beat refreshes the heartbeat of the run, it returns false when the run is no longer running.
+func (r *reportController) beat(ctx context.Context, schema string, reportID int64, attempt int) (bool, error) {
+	uq := r.dialect.Update(goqu.S(schema).Table("download_report")).Set(
+		goqu.Record{"heartbeat": goqu.L("now()")},
+	).Where(goqu.Ex{"id": reportID}, inRun(attempt, StatusRunning)).Prepared(true)
+	q, args, err := uq.ToSQL()
+	if err != nil {
+		return false, err
+	}
+	tag, err := r.conn.Exec(ctx, q, args...)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// storeProgress stores the completion percentage of the run, failures are only logged as for the events.
+func (r *reportController) storeProgress(ctx context.Context, job worker.Job, attempt int, percent int) {
+	uq := r.dialect.Update(goqu.S(job.Schema).Table("download_report")).Set(
+		goqu.Record{"progress": percent},
+	).Where(goqu.Ex{"id": job.ReportID}, inRun(attempt, StatusRunning)).Prepared(true)
+	q, args, err := uq.ToSQL()
+	if err == nil {
+		_, err = r.conn.Exec(ctx, q, args...)
+	}
+	if err != nil && ctx.Err() == nil {
+		r.logger.WithContext(ctx).WithError(err).WithField("report_id", job.ReportID).Warn("Unable to store the report progress")
+	}
+}
+
+// release clears the heartbeat of a cancelled run once it has stopped, so the report can be retried, and
+// removes the file it generated, if any.
+func (r *reportController) release(ctx context.Context, job worker.Job, attempt int, record goqu.Record) error {
+	if key, ok := record["file_path"].(string); ok {
+		if err := r.store.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	uq := r.dialect.Update(goqu.S(job.Schema).Table("download_report")).Set(
+		goqu.Record{"heartbeat": nil},
+	).Where(goqu.Ex{"id": job.ReportID, "attempt": attempt}).Prepared(true)
+	q, args, err := uq.ToSQL()
+	if err != nil {
+		return err
+	}
+	_, err = r.conn.Exec(ctx, q, args...)
+	return err
+}
+
+// requeue moves the report interrupted by a shutdown back to queued and enqueues it again. The jobs
+// left queued because the queue is closed are enqueued by Requeue on the next start.
+func (r *reportController) requeue(ctx context.Context, job worker.Job, attempt int) error {
+	// The job context is done, the request id and span are kept for the logs and traces.
+	detached := trace.ContextWithSpan(logging.WithRequestID(context.Background(), logging.RequestID(ctx)),
+		trace.SpanFromContext(ctx))
+	ctx, cancel := context.WithTimeout(detached, requeueTimeout)
+	defer cancel()
+	ok, err := r.transition(ctx, job.Schema, job.ReportID, inRun(attempt, StatusRunning), StatusQueued,
+		ReportInterrupted, goqu.Record{"heartbeat": nil})
+	if err != nil || !ok {
+		return err
+	}
+	if err := r.queue.Enqueue(ctx, job); err != nil && !errors.Is(err, worker.ErrQueueClosed) {
+		return err
+	}
+	return nil
+}
+
+// Requeue enqueues the queued reports of the tenants, so the reports left queued by a shutdown are
+// generated after a restart. The reports picked up twice are skipped by the second worker.
+func (r *reportController) Requeue(ctx context.Context, schemas []string) error {
+	for _, schema := range schemas {
+		nq := r.dialect.From(goqu.S(schema).Table("download_report")).Select("id").Where(
+			goqu.Ex{"status": StatusQueued},
+		).Order(goqu.I("id").Asc()).Prepared(true)
+		q, args, err := nq.ToSQL()
+		if err != nil {
+			return err
+		}
+		r.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+		res, err := r.conn.Query(ctx, q, args...)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgUndefinedTable {
+				continue
+			}
+			return err
+		}
+		var ids []int64
+		for res.Next() {
+			var id int64
+			if err := res.Scan(&id); err != nil {
+				res.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		res.Close()
+		if err := res.Err(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := r.queue.Enqueue(ctx, worker.Job{ReportID: id, Schema: schema}); err != nil {
+				return err
+			}
+		}
+		if len(ids) > 0 {
+			r.logger.WithContext(ctx).WithFields(logrus.Fields{"schema": schema, "reports": len(ids)}).Info(
+				"Queued reports enqueued again")
+		}
+	}
+	return nil
+}
+
+// Recover queues again the reports left running by a worker which stopped without finishing them, e.g. killed
+// or crashed, their heartbeat is older than staleRun. The cancelled runs of such a worker are released, so the
+// reports can be retried. Every replica may run it, each report is only queued again once.
+func (r *reportController) Recover(ctx context.Context, schemas []string) error {
+	cutoff := goqu.L("now() - make_interval(secs => ?)", staleRun.Seconds())
+	for _, schema := range schemas {
+		tbl := goqu.S(schema).Table("download_report")
+		uq := r.dialect.Update(tbl).Set(goqu.Record{"heartbeat": nil}).Where(
+			goqu.Ex{"status": StatusCancelled, "heartbeat": goqu.Op{"lt": cutoff}},
+		).Prepared(true)
+		q, args, err := uq.ToSQL()
+		if err != nil {
+			return err
+		}
+		r.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+		if _, err := r.conn.Exec(ctx, q, args...); err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgUndefinedTable {
+				continue
+			}
+			return err
+		}
+
+		nq := r.dialect.From(tbl).Select("id", "attempt").Where(
+			goqu.Ex{"status": StatusRunning, "heartbeat": goqu.Op{"lt": cutoff}},
+		).Order(goqu.I("id").Asc()).Prepared(true)
+		q, args, err = nq.ToSQL()
+		if err != nil {
+			return err
+		}
+		r.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+		res, err := r.conn.Query(ctx, q, args...)
+		if err != nil {
+			return err
+		}
+		type run struct {
+			id      int64
+			attempt int
+		}
+		var runs []run
+		for res.Next() {
+			var rn run
+			if err := res.Scan(&rn.id, &rn.attempt); err != nil {
+				res.Close()
+				return err
+			}
+			runs = append(runs, rn)
+		}
+		res.Close()
+		if err := res.Err(); err != nil {
+			return err
+		}
+		recovered := 0
+		for _, rn := range runs {
+			// The heartbeat is checked again, another replica may have queued the report meanwhile.
+			from := inRun(rn.attempt, StatusRunning)
+			from["heartbeat"] = goqu.Op{"lt": cutoff}
+			ok, err := r.transition(ctx, schema, rn.id, from, StatusQueued, ReportAbandoned, goqu.Record{"heartbeat": nil})
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := r.queue.Enqueue(ctx, worker.Job{ReportID: rn.id, Schema: schema}); err != nil {
+				return err
+			}
+			recovered++
+		}
+		if recovered > 0 {
+			r.logger.WithContext(ctx).WithFields(logrus.Fields{"schema": schema, "reports": recovered}).Warn(
+				"Abandoned reports queued again")
+		}
+	}
+	return nil
+}
+
+// generate writes the report workbook using the stored filter payload, it returns the
+// download_report columns describing the generated file.
+func (r *reportController) generate(ctx context.Context, job worker.Job, attempt int, reportType string,
+	payload []byte) (goqu.Record, error) {
+	request := Request{}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, err
+		}
+	}
+	// The workbook is written to a temporary file first, so the store gets the final size.
+	f, err := os.CreateTemp("", "report-*.xlsx")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// The progress is stored too, for the clients reading the run or subscribing while it is running.
+	last := -1
+	progress := func(percent int) {
+		if percent == last {
+			return
+		}
+		last = percent
+		r.storeProgress(ctx, job, attempt, percent)
+		r.publish(ctx, job.Schema, job.ReportID, StatusRunning, percent, "")
+	}
+	counts, err := r.writeWorkbook(ctx, job.Schema, reportType, request, f, progress)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// Every attempt has its own file, a cancelled run never removes the file of the run retried after it.
+	key := path.Join(job.Schema, "reports", fmt.Sprintf("report-%d-%d.xlsx", job.ReportID, attempt))
+	if err := r.store.Put(ctx, key, f, size, ContentTypeXLSX); err != nil {
+		return nil, err
+	}
+	result, err := json.Marshal(counts)
+	if err != nil {
+		return nil, err
+	}
+	rowCount := 0
+	for _, c := range counts {
+		rowCount += c
+	}
+	return goqu.Record{
+		"result":    string(result),
+		"row_count": rowCount,
+		"file_name": fmt.Sprintf("%s-%d.xlsx", reportType, job.ReportID),
+		"file_path": key,
+		"file_size": size,
+	}, nil
+}
+
+// DownloadArtifact returns the generated file of a completed report run of the user, a signed URL
+// is returned when the store supports it, the file content otherwise.
+func (r *reportController) DownloadArtifact(ctx context.Context, schema string, userID int64, reportID int64) (*Artifact, error) {
+	nq := r.dialect.From(goqu.S(schema).Table("download_report")).Select(
+		"status", "file_name", "file_path", "file_size",
+	).Where(goqu.Ex{"id": reportID, "user_id": userID}).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		status   string
+		fileName sql.NullString
+		filePath sql.NullString
+		fileSize sql.NullInt64
+	)
+	if err := r.conn.QueryRow(ctx, q, args...).Scan(&status, &fileName, &filePath, &fileSize); err != nil {
+		return nil, err
+	}
+	if status != StatusCompleted || !filePath.Valid {
+		return nil, helpers.ErrReportNotReady
+	}
+
+	a := Artifact{FileName: fileName.String, Size: fileSize.Int64, ContentType: ContentTypeXLSX}
+	a.URL, err = r.store.SignedURL(ctx, filePath.String, SignedURLExpiry, a.FileName)
+	switch err {
+	case nil:
+		return &a, nil
+	case storage.ErrSignedURLNotSupported:
+		a.Body, err = r.store.Get(ctx, filePath.String)
+		if err != nil {
+			return nil, err
+		}
+		return &a, nil
+	default:
+		return nil, err
+	}
+}
+
+// Download lists the report runs of the user, AllUsers lists the runs of every user of the tenant.
+func (r *reportController) Download(ctx context.Context, schema string, userID int64, url string, filter DownloadFilter) (*PaginatedResult, error) {
 
 	tblDownloadReport := goqu.S(schema).Table("download_report")
 	tblReportModelMap := goqu.S(schema).Table("report_model_map")
 	tblReportType := goqu.S(schema).Table("report_type")
-	nq := r.dialect.From(tblDownloadReport).Select(
-		"download_report.id", "download_report.status", "report_type.name",
-		"download_report.created", "download_report.modified",
-	).InnerJoin(
+	if filter.PageSize == 0 {
+		filter.PageSize = 100
+	}
+	if filter.PageNumber <= 0 {
+		filter.PageNumber = 1
+	}
+	limit := filter.PageSize
+	offset := (limit * filter.PageNumber) - limit
+
+	nq := r.dialect.From(tblDownloadReport).InnerJoin(
 		tblReportModelMap, goqu.On(goqu.Ex{
 			"report_model_map.id": goqu.I("download_report.report_map_id"),
 		}),
@@ -60,44 +612,105 @@ func (r *reportController) Download(ctx context.Context, schema string, userID i
 		tblReportType, goqu.On(goqu.Ex{
 			"report_model_map.report_type_id": goqu.I("report_type.id"),
 		}),
-	).Prepared(true)
-	sql, args, err := nq.ToSQL()
+	)
+	if !filter.AllUsers {
+		nq = nq.Where(goqu.Ex{"download_report.user_id": userID})
+	} else if filter.UserID > 0 {
+		nq = nq.Where(goqu.Ex{"download_report.user_id": filter.UserID})
+	}
+	if len(filter.Status) > 0 {
+		nq = nq.Where(goqu.Ex{"download_report.status": filter.Status})
+	}
+	if len(filter.ReportType) > 0 {
+		nq = nq.Where(goqu.Ex{"report_type.name": filter.ReportType})
+	}
+	if filter.CreatedFrom.Unix() > 0 {
+		nq = nq.Where(goqu.I("download_report.created").Gte(filter.CreatedFrom))
+	}
+	if filter.CreatedTo.Unix() > 0 {
+		nq = nq.Where(goqu.I("download_report.created").Lte(filter.CreatedTo))
+	}
+	nq = nq.Prepared(true)
+
+	var count uint
+	q, args, err := nq.Select(goqu.COUNT("download_report.id")).ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	observe := metrics.ObserveQuery("report", "downloads_count")
+	err = r.conn.QueryRow(ctx, q, args...).Scan(&count)
+	observe()
 	if err != nil {
 		return nil, err
 	}
 
-	r.logger.WithFields(logrus.Fields{"query": sql, "params": args}).Debug("Running ...")
-	res, err := r.conn.Query(ctx, sql, args...)
+	q, args, err = nq.Select(
+		"download_report.id", "download_report.user_id", "download_report.status", "report_type.name",
+		"download_report.file_name", "download_report.file_size",
+		"download_report.created", "download_report.modified",
+	).Order(goqu.I("download_report.created").Desc(), goqu.I("download_report.id").Desc()).Limit(limit).Offset(offset).ToSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	defer metrics.ObserveQuery("report", "downloads")()
+	res, err := r.conn.Query(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Close()
+	st := tenant.SettingsFrom(ctx)
 	results := []*Download{}
 	for res.Next() {
 		var (
 			created  time.Time
 			modified time.Time
+			owner    sql.NullInt64
+			fileName sql.NullString
+			fileSize sql.NullInt64
 		)
 
 		d := Download{}
-		err := res.Scan(&d.ID, &d.Status, &d.ReportName, &created, &modified)
+		err := res.Scan(&d.ID, &owner, &d.Status, &d.ReportName, &fileName, &fileSize, &created, &modified)
 		if err != nil {
 			return nil, err
 		}
-		d.Created = created.Format(time.RFC3339)
-		d.Modified = modified.Format(time.RFC3339)
+		d.UserID = owner.Int64
+		d.FileName = fileName.String
+		d.FileSize = fileSize.Int64
+		d.Created = st.Format(created)
+		d.Modified = st.Format(modified)
 		results = append(results, &d)
 	}
-	return results, nil
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+
+	if count == 0 && filter.PageNumber == 1 {
+		// A user without runs gets an empty first page rather than ErrPageLimitExceeded.
+		return &PaginatedResult{Result: results}, nil
+	}
+	paginator := Paginator{}
+	p, err := paginator.Pagination(url, filter.PageNumber, filter.PageSize, count)
+	if err != nil {
+		return nil, err
+	}
+	return &PaginatedResult{Result: results, Count: count, Paginator: *p}, nil
 }
 
 func (r *reportController) Store(ctx context.Context, schema string, userID int64, request Request) ([]*Store, error) {
+	scopeRequest(ctx, userID, &request)
 	tblStore := goqu.S(schema).Table("store_store")
 	nq := r.dialect.From(tblStore).Select("id", "title").Where(
 		goqu.Ex{
 			"is_active": true,
 		},
 	).Limit(500)
+	if request.ScopeUserID > 0 {
+		nq = nq.Where(goqu.I("store_store.id").In(r.scopeStores(schema, request.ScopeUserID)))
+	}
 	if len(request.StoreBrand) > 0 {
 		nq = nq.Where(
 			goqu.Ex{"store_brand_id": request.StoreBrand},
@@ -113,6 +726,7 @@ func (r *reportController) Store(ctx context.Context, schema string, userID int6
 	if err != nil {
 		return nil, err
 	}
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
 	res, err := r.conn.Query(ctx, q, args...)
 	if err != nil {
 		return nil, err
@@ -125,11 +739,11 @@ func (r *reportController) Store(ctx context.Context, schema string, userID int6
 		storeList = append(storeList, &store)
 
 	}
-	fmt.Println(storeList)
 	return storeList, nil
 }
 
 func (r *reportController) StoreBrand(ctx context.Context, schema string, userID int64, request Request) ([]*StoreBrand, error) {
+	scopeRequest(ctx, userID, &request)
 	tblStore := goqu.S(schema).Table("store_store")
 	tblStoreBrand := goqu.S(schema).Table("store_storebrand")
 	nq := r.dialect.From(tblStore).Select("store_storebrand.id", "store_storebrand.title").Distinct().InnerJoin(
@@ -137,6 +751,9 @@ func (r *reportController) StoreBrand(ctx context.Context, schema string, userID
 			"store_storebrand.id": goqu.I("store_store.store_brand_id"),
 		}),
 	).Where(goqu.Ex{"store_storebrand.is_active": true, "store_store.is_active": true})
+	if request.ScopeUserID > 0 {
+		nq = nq.Where(goqu.I("store_store.id").In(r.scopeStores(schema, request.ScopeUserID)))
+	}
 
 	if len(request.StoreChannel) > 0 {
 		nq = nq.Where(
@@ -145,10 +762,10 @@ func (r *reportController) StoreBrand(ctx context.Context, schema string, userID
 	}
 	nq = nq.Prepared(true)
 	q, args, err := nq.ToSQL()
-	fmt.Println(q)
 	if err != nil {
 		return nil, err
 	}
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
 	res, err := r.conn.Query(ctx, q, args...)
 	if err != nil {
 		return nil, err
@@ -165,14 +782,18 @@ func (r *reportController) StoreBrand(ctx context.Context, schema string, userID
 }
 
 func (r *reportController) StoreChannel(ctx context.Context, schema string, userID int64, request Request) ([]*StoreChannel, error) {
+	scopeRequest(ctx, userID, &request)
 	tblStore := goqu.S(schema).Table("store_store")
 	tblStoreChannel := goqu.S(schema).Table("store_storetype")
 	nq := r.dialect.From(tblStore).Select("store_storetype.id", "store_store.title").Distinct().InnerJoin(
 		tblStoreChannel, goqu.On(goqu.Ex{
 			"store_storetype.id": goqu.I("store_store.store_type_id"),
 		}),
-	).Where(goqu.Ex{"store_storetype.is_active": true, "store_store.is_active": true}).Prepared(true)
-	q, args, err := nq.ToSQL()
+	).Where(goqu.Ex{"store_storetype.is_active": true, "store_store.is_active": true})
+	if request.ScopeUserID > 0 {
+		nq = nq.Where(goqu.I("store_store.id").In(r.scopeStores(schema, request.ScopeUserID)))
+	}
+	q, args, err := nq.Prepared(true).ToSQL()
 	if err != nil {
 		return nil, err
 	}
@@ -213,8 +834,12 @@ func (r *reportController) Category(ctx context.Context, schema string, userID i
 }
 
 func (r *reportController) Users(ctx context.Context, schema string, userID int64, request Request) ([]*User, error) {
+	scopeRequest(ctx, userID, &request)
 	tblUser := goqu.S(schema).Table("auth_user")
 	nq := r.dialect.From(tblUser).Select("id", "username").Where(goqu.Ex{"is_active": true}).Limit(30)
+	if request.ScopeUserID > 0 {
+		nq = nq.Where(goqu.I("auth_user.id").In(r.scopeUsers(schema, request.ScopeUserID)))
+	}
 	q, args, err := nq.ToSQL()
 	if err != nil {
 		return nil, err
@@ -233,21 +858,19 @@ func (r *reportController) Users(ctx context.Context, schema string, userID int6
 	return userList, nil
 }
 
-func (r *reportController) PhotoSessions(ctx context.Context, schema string, userID int64, url string, request Request) (*PaginatedResult, error) {
+// photoSessionColumns are the selected columns scanned by scanPhotoSession.
+var photoSessionColumns = []interface{}{
+	"photo_photosession.session_id", "photo_photosession.photo_count", "store_store.id", "store_store.title",
+	"auth_user.id", "auth_user.username", "common_category.id", "common_category.title",
+	"photo_photosession.created_on", "photo_photosession.visit_timestamp",
+}
 
+// photoSessionQuery builds the photo session query with the filters of the request applied.
+func (r *reportController) photoSessionQuery(schema string, request Request) *goqu.SelectDataset {
 	tblPhotoSession := goqu.S(schema).Table("photo_photosession")
 	tblStore := goqu.S(schema).Table("store_store")
 	tblUser := goqu.S(schema).Table("auth_user")
 	tblCategory := goqu.S(schema).Table("common_category")
-	fmt.Println(request)
-	if request.PageSize == 0 {
-		request.PageSize = 100
-	}
-	if request.PageNumber <= 0 {
-		request.PageNumber = 1
-	}
-	limit := request.PageSize
-	offset := (limit * request.PageNumber) - limit
 
 	nq := r.dialect.From(tblPhotoSession).Join(
 		tblStore, goqu.On(goqu.Ex{
@@ -271,6 +894,10 @@ func (r *reportController) PhotoSessions(ctx context.Context, schema string, use
 		// TODO: Logic to get the store id and assign to store
 	}
 
+	if request.ScopeUserID > 0 {
+		nq = nq.Where(goqu.I("photo_photosession.store_id").In(r.scopeStores(schema, request.ScopeUserID)))
+	}
+
 	if len(request.PhotoType) > 0 {
 		nq = nq.Where(
 			goqu.Ex{"photo_photosession.photo_type_id": request.PhotoType},
@@ -285,63 +912,91 @@ func (r *reportController) PhotoSessions(ctx context.Context, schema string, use
 	if request.VisitedFrom.Unix() > 0 && request.VisitedTo.Unix() > 0 {
 		nq = nq.Where(
 			goqu.And(
-				goqu.C("visit_timestamp").Table("photo_photosession").Schema(schema).Gt(request.VisitedFrom.Format(time.RFC3339)),
-				goqu.C("visit_timestamp").Table("photo_photosession").Schema(schema).Lte(request.VisitedTo.Format(time.RFC3339)),
+				goqu.C("visit_timestamp").Table("photo_photosession").Schema(schema).Gt(request.VisitedFrom),
+				goqu.C("visit_timestamp").Table("photo_photosession").Schema(schema).Lte(request.VisitedTo),
 			),
 		)
 	}
+	return nq
+}
+
+// scanPhotoSession scans a row selected with photoSessionColumns, the dates are formatted with the settings. They
+// are RFC822 dates for the tenants without a date format or locale.
+func scanPhotoSession(res pgx.Rows, st tenant.Settings) (*PhotoSession, error) {
+	p := PhotoSession{}
+	s := Store{}
+	u := User{}
+	c := Category{}
+
+	var (
+		created time.Time
+		visited sql.NullTime
+	)
+
+	err := res.Scan(&p.ID, &p.PhotoCount, &s.ID, &s.Name, &u.ID, &u.Name, &c.ID, &c.Name, &created, &visited)
+	if err != nil {
+		return nil, err
+	}
+
+	p.CreatedAt = st.FormatOr(created, time.RFC822)
+	p.createdOn = created
+	p.visitedOn = visited
+
+	if visited.Valid {
+		p.VisitedOn = st.FormatOr(visited.Time, time.RFC822)
+	}
+
+	p.Store = s
+	p.PhotoTakenBy = u
+	p.Category = c
+	return &p, nil
+}
+
+func (r *reportController) PhotoSessions(ctx context.Context, schema string, userID int64, url string, request Request) (*PaginatedResult, error) {
+	scopeRequest(ctx, userID, &request)
+
+	if request.PageSize == 0 {
+		request.PageSize = 100
+	}
+	if request.PageNumber <= 0 {
+		request.PageNumber = 1
+	}
+	limit := request.PageSize
+	offset := (limit * request.PageNumber) - limit
+
+	nq := r.photoSessionQuery(schema, request)
 	var count uint
 	countGoQuery := nq.Select(goqu.COUNT("photo_photosession.id"))
 	countQuery, args, _ := countGoQuery.ToSQL()
-	r.logger.WithFields(logrus.Fields{"Query": countQuery, "args": args}).Debug("query for photo session")
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"Query": countQuery, "args": args}).Debug("query for photo session")
+	observe := metrics.ObserveQuery("report", "photo_sessions_count")
 	err := r.conn.QueryRow(ctx, countQuery, args...).Scan(&count)
+	observe()
 	if err != nil {
 		return nil, err
 	}
 
-	nq = nq.Select(
-		"photo_photosession.session_id", "photo_photosession.photo_count", "store_store.id", "store_store.title",
-		"auth_user.id", "auth_user.username", "common_category.id", "common_category.title",
-		"photo_photosession.created_on", "photo_photosession.visit_timestamp",
-	).Order(goqu.I("photo_photosession.created_on").Desc()).Limit(limit).Offset(offset).Prepared(false)
+	nq = nq.Select(photoSessionColumns...).Order(goqu.I("photo_photosession.created_on").Desc()).Limit(limit).Offset(offset).Prepared(false)
 	q, args, err := nq.ToSQL()
 
 	if err != nil {
 		return nil, err
 	}
-	r.logger.WithFields(logrus.Fields{"Query": q, "args": args}).Debug("query for photo session")
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"Query": q, "args": args}).Debug("query for photo session")
+	defer metrics.ObserveQuery("report", "photo_sessions")()
 	res, err := r.conn.Query(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Close()
+	st := tenant.SettingsFrom(ctx)
 	results := []*PhotoSession{}
 	for res.Next() {
-		p := PhotoSession{}
-		s := Store{}
-		u := User{}
-		c := Category{}
-
-		var (
-			created time.Time
-			visited sql.NullTime
-		)
-
-		err := res.Scan(&p.ID, &p.PhotoCount, &s.ID, &s.Name, &u.ID, &u.Name, &c.ID, &c.Name, &created, &visited)
+		p, err := scanPhotoSession(res, st)
 		if err != nil {
 			return nil, err
 		}
-
-		p.CreatedAt = created.Format(time.RFC822)
-
-		if visited.Valid {
-			p.VisitedOn = visited.Time.Format(time.RFC822)
-		}
-
-		p.Store = s
-		p.PhotoTakenBy = u
-		p.Category = c
-		results = append(results, &p)
+		results = append(results, p)
 	}
 
 	paginator := Paginator{}
@@ -355,6 +1010,72 @@ func (r *reportController) PhotoSessions(ctx context.Context, schema string, use
 	return &paginationResult, nil
 }
 
+// ExportPhotoSessions streams every photo session matching the request to fn, the rows are
+// fetched in batches from a server side cursor so the memory usage does not grow with the result.
+func (r *reportController) ExportPhotoSessions(ctx context.Context, schema string, userID int64, request Request, fn func(*PhotoSession) error) error {
+	scopeRequest(ctx, userID, &request)
+	nq := r.photoSessionQuery(schema, request).Select(photoSessionColumns...).Order(
+		goqu.I("photo_photosession.created_on").Desc(),
+	).Prepared(false)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"Query": q, "args": args}).Debug("query for photo session export")
+	st := tenant.SettingsFrom(ctx)
+	defer metrics.ObserveQuery("report", "photo_sessions_export")()
+	err = r.fetchCursor(ctx, tx, "photo_session_export", q, args, func(res pgx.Rows) error {
+		p, err := scanPhotoSession(res, st)
+		if err != nil {
+			return err
+		}
+		return fn(p)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// fetchCursor declares a cursor for the query inside the transaction and passes every row to fn,
+// the rows are fetched in batches of exportBatchSize.
+func (r *reportController) fetchCursor(ctx context.Context, tx pgx.Tx, name string, q string, args []interface{}, fn func(pgx.Rows) error) error {
+	cursor := pgx.Identifier{name}.Sanitize()
+	if _, err := tx.Exec(ctx, "DECLARE "+cursor+" NO SCROLL CURSOR FOR "+q, args...); err != nil {
+		return err
+	}
+	fetch := fmt.Sprintf("FETCH %d FROM %s", exportBatchSize, cursor)
+	for {
+		res, err := tx.Query(ctx, fetch)
+		if err != nil {
+			return err
+		}
+		count := 0
+		for res.Next() {
+			count++
+			if err := fn(res); err != nil {
+				res.Close()
+				return err
+			}
+		}
+		res.Close()
+		if err := res.Err(); err != nil {
+			return err
+		}
+		if count < exportBatchSize {
+			_, err := tx.Exec(ctx, "CLOSE "+cursor)
+			return err
+		}
+	}
+}
+
 func (r *reportController) PhotoTypes(ctx context.Context, schema string, userID int64, request Request) ([]*PhotoType, error) {
 	tblPhotoType := goqu.S(schema).Table("common_phototype")
 	nq := r.dialect.From(tblPhotoType).Select("id", "title")
@@ -0,0 +1,315 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/crazi-coder/report-service/core/events"
+	"github.com/crazi-coder/report-service/core/metrics"
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgx/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// DownloadDetail returns a single report run of the user along with its status history.
+func (r *reportController) DownloadDetail(ctx context.Context, schema string, userID int64, reportID int64) (*DownloadDetail, error) {
+	tblDownloadReport := goqu.S(schema).Table("download_report")
+	tblReportModelMap := goqu.S(schema).Table("report_model_map")
+	tblReportType := goqu.S(schema).Table("report_type")
+	tblStatus := goqu.S(schema).Table("download_report_status")
+
+	nq := r.dialect.From(tblDownloadReport).Select(
+		"download_report.id", "download_report.status", "report_type.name",
+		"download_report.file_name", "download_report.file_size",
+		"download_report.created", "download_report.modified",
+		"download_report.error_message", "download_report.row_count", "download_report.request",
+		"download_report.progress",
+	).InnerJoin(
+		tblReportModelMap, goqu.On(goqu.Ex{
+			"report_model_map.id": goqu.I("download_report.report_map_id"),
+		}),
+	).InnerJoin(
+		tblReportType, goqu.On(goqu.Ex{
+			"report_model_map.report_type_id": goqu.I("report_type.id"),
+		}),
+	).Where(goqu.Ex{"download_report.id": reportID, "download_report.user_id": userID}).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+
+	var (
+		created      time.Time
+		modified     time.Time
+		fileName     sql.NullString
+		fileSize     sql.NullInt64
+		errorMessage sql.NullString
+		rowCount     sql.NullInt64
+		request      []byte
+		progress     int
+	)
+	d := DownloadDetail{History: []*DownloadStatus{}}
+	observe := metrics.ObserveQuery("report", "download_detail")
+	err = r.conn.QueryRow(ctx, q, args...).Scan(&d.ID, &d.Status, &d.ReportName, &fileName, &fileSize,
+		&created, &modified, &errorMessage, &rowCount, &request, &progress)
+	observe()
+	if err != nil {
+		return nil, err
+	}
+	d.FileName = fileName.String
+	d.FileSize = fileSize.Int64
+	st := tenant.SettingsFrom(ctx)
+	d.Created = st.Format(created)
+	d.Modified = st.Format(modified)
+	d.ErrorMessage = errorMessage.String
+	d.RowCount = rowCount.Int64
+	d.Progress = runPercent(d.Status, progress)
+	if len(request) > 0 {
+		d.Request = json.RawMessage(request)
+	}
+
+	hq := r.dialect.From(tblStatus).Select("status", "message", "created").Where(
+		goqu.Ex{"report_id": reportID},
+	).Order(goqu.I("created").Asc(), goqu.I("id").Asc()).Prepared(true)
+	q, args, err = hq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	for res.Next() {
+		var (
+			message sql.NullString
+			changed time.Time
+		)
+		h := DownloadStatus{}
+		if err := res.Scan(&h.Status, &message, &changed); err != nil {
+			return nil, err
+		}
+		h.Message = message.String
+		h.Created = st.Format(changed)
+		d.History = append(d.History, &h)
+	}
+	return &d, res.Err()
+}
+
+// CancelDownload cancels a queued or running report run of the user.
+func (r *reportController) CancelDownload(ctx context.Context, schema string, userID int64, reportID int64) (*DownloadDetail, error) {
+	if _, err := r.DownloadDetail(ctx, schema, userID, reportID); err != nil {
+		return nil, err
+	}
+	// The worker of a running report notices the cancellation on its next heartbeat and stops.
+	ok, err := r.transition(ctx, schema, reportID, inStatus(StatusQueued, StatusRunning), StatusCancelled,
+		"cancelled by the user", nil)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, helpers.ErrInvalidReportStatus
+	}
+	return r.DownloadDetail(ctx, schema, userID, reportID)
+}
+
+// RetryDownload queues a failed or cancelled report run of the user again, once the worker of a cancelled
+// run has stopped.
+func (r *reportController) RetryDownload(ctx context.Context, schema string, userID int64, reportID int64) (*DownloadDetail, error) {
+	d, err := r.DownloadDetail(ctx, schema, userID, reportID)
+	if err != nil {
+		return nil, err
+	}
+	where := inStatus(StatusFailed, StatusCancelled)
+	where["heartbeat"] = nil
+	ok, err := r.transition(ctx, schema, reportID, where, StatusQueued, "retried by the user",
+		goqu.Record{"error_message": nil})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if d.Status == StatusCancelled {
+			return nil, helpers.ErrReportStopping
+		}
+		return nil, helpers.ErrInvalidReportStatus
+	}
+	if err := r.enqueue(ctx, schema, reportID); err != nil {
+		return nil, err
+	}
+	return r.DownloadDetail(ctx, schema, userID, reportID)
+}
+
+// inStatus matches the reports in one of the statuses.
+func inStatus(statuses ...string) goqu.Ex {
+	return goqu.Ex{"status": statuses}
+}
+
+// inRun matches the run of the attempt while it is in one of the statuses, so a worker does not update
+// the runs started after its own.
+func inRun(attempt int, statuses ...string) goqu.Ex {
+	return goqu.Ex{"status": statuses, "attempt": attempt}
+}
+
+// transition moves the report to the given status if it currently matches from, e.g. inStatus(StatusQueued),
+// the change is recorded in the status history. It returns false when the report did not match.
+func (r *reportController) transition(ctx context.Context, schema string, reportID int64, from goqu.Ex,
+	to string, message string, extra goqu.Record) (bool, error) {
+
+	now := time.Now().UTC()
+	record := goqu.Record{"status": to, "modified": now}
+	for k, v := range extra {
+		record[k] = v
+	}
+	uq := r.dialect.Update(goqu.S(schema).Table("download_report")).Set(record).Where(
+		goqu.Ex{"id": reportID}, from,
+	).Prepared(true)
+	q, args, err := uq.ToSQL()
+	if err != nil {
+		return false, err
+	}
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+
+	tx, err := r.conn.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, q, args...)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+	if err := r.addHistory(ctx, tx, schema, reportID, to, message, now); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, err
+	}
+	r.publish(ctx, schema, reportID, to, runPercent(to, 0), message)
+	return true, nil
+}
+
+// WatchDownload streams the status and progress events of a report run of the user. The current
+// status is sent first, the channel is closed once the run is finished or the context is done. The status is
+// read again periodically and after the event listener reconnected, so a missed final event does not leave
+// the stream open.
+func (r *reportController) WatchDownload(ctx context.Context, schema string, userID int64, reportID int64) (<-chan events.Event, error) {
+	// Subscribe before reading the current status, so no transition is missed in between.
+	ch, unsubscribe := r.events.Subscribe(schema, reportID)
+	d, err := r.DownloadDetail(ctx, schema, userID, reportID)
+	if err != nil {
+		unsubscribe()
+		return nil, err
+	}
+	out := make(chan events.Event)
+	go func() {
+		defer close(out)
+		defer unsubscribe()
+		ticker := time.NewTicker(watchResync)
+		defer ticker.Stop()
+		e := events.Event{Schema: schema, ReportID: reportID, Status: d.Status, Percent: d.Progress}
+		for {
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+			if isFinished(e.Status) {
+				return
+			}
+			status, changed := e.Status, false
+			for !changed {
+				select {
+				case ev, ok := <-ch:
+					if !ok {
+						// The broker is closed, the server is shutting down.
+						return
+					}
+					e, changed = ev, !ev.Resync
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+				if !changed {
+					e, changed = r.resync(ctx, schema, reportID, status)
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+// resync reads the status of the report, it returns its event when it differs from the status sent last.
+func (r *reportController) resync(ctx context.Context, schema string, reportID int64, sent string) (events.Event, bool) {
+	nq := r.dialect.From(goqu.S(schema).Table("download_report")).Select("status", "progress").Where(
+		goqu.Ex{"id": reportID},
+	).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return events.Event{}, false
+	}
+	var (
+		status   string
+		progress int
+	)
+	if err := r.conn.QueryRow(ctx, q, args...).Scan(&status, &progress); err != nil {
+		if ctx.Err() == nil {
+			r.logger.WithContext(ctx).WithError(err).WithField("report_id", reportID).Warn("Unable to read the report status")
+		}
+		return events.Event{}, false
+	}
+	if status == sent {
+		return events.Event{}, false
+	}
+	return events.Event{Schema: schema, ReportID: reportID, Status: status, Percent: runPercent(status, progress)}, true
+}
+
+// publish sends a report event, failures are only logged as events are informational.
+func (r *reportController) publish(ctx context.Context, schema string, reportID int64, status string, percent int, message string) {
+	e := events.Event{Schema: schema, ReportID: reportID, Status: status, Percent: percent, Message: message}
+	if err := r.events.Publish(ctx, e); err != nil {
+		r.logger.WithContext(ctx).WithError(err).WithField("report_id", reportID).Warn("Unable to publish the report event")
+	}
+}
+
+// runPercent returns the completion percentage of a run in the status, progress is the one stored by the
+// running attempt.
+func runPercent(status string, progress int) int {
+	switch status {
+	case StatusCompleted:
+		return 100
+	case StatusRunning:
+		return progress
+	default:
+		return 0
+	}
+}
+
+// isFinished returns true if the status is final for the run.
+func isFinished(status string) bool {
+	return status == StatusCompleted || status == StatusFailed || status == StatusCancelled
+}
+
+// addHistory records a status change of the report.
+func (r *reportController) addHistory(ctx context.Context, tx pgx.Tx, schema string, reportID int64,
+	status string, message string, created time.Time) error {
+
+	record := goqu.Record{"report_id": reportID, "status": status, "created": created}
+	if message != "" {
+		record["message"] = message
+	}
+	iq := r.dialect.Insert(goqu.S(schema).Table("download_report_status")).Rows(record).Prepared(true)
+	q, args, err := iq.ToSQL()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, q, args...)
+	return err
+}
@@ -0,0 +1,455 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+	_ "time/tzdata" // The container images do not ship the zoneinfo database.
+
+	"github.com/crazi-coder/report-service/core/metrics"
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/crazi-coder/report-service/core/tracing"
+	"github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// windowLastDays matches the "last_<n>_days" windows.
+var windowLastDays = regexp.MustCompile(`^last_(\d+)_days$`)
+
+// scheduleColumns are the report_schedule columns read by scanSchedule.
+var scheduleColumns = []interface{}{
+	"id", "name", "report_type", "cron", "timezone", "window", "is_active", "request",
+	"next_run", "last_run", "last_report_id", "last_error", "created", "modified",
+}
+
+type ScheduleController interface {
+	Schedules(ctx context.Context, schema string, userID int64) ([]*Schedule, error)
+	Schedule(ctx context.Context, schema string, userID int64, scheduleID int64) (*Schedule, error)
+	CreateSchedule(ctx context.Context, schema string, userID int64, request ScheduleRequest) (*Schedule, error)
+	UpdateSchedule(ctx context.Context, schema string, userID int64, scheduleID int64, request ScheduleRequest) (*Schedule, error)
+	DeleteSchedule(ctx context.Context, schema string, userID int64, scheduleID int64) error
+	RunDue(ctx context.Context, now time.Time) error
+}
+
+type scheduleController struct {
+	conn    tracing.Querier
+	ctx     context.Context
+	logger  *logrus.Logger
+	dialect goqu.DialectWrapper
+	reports ReportController
+	tenants *tenant.Registry
+}
+
+func NewScheduleController(ctx context.Context, logger *logrus.Logger, conn *pgxpool.Pool,
+	reports ReportController, tenants *tenant.Registry) ScheduleController {
+
+	return &scheduleController{ctx: ctx, logger: logger, conn: tracing.WrapDB(conn), dialect: goqu.Dialect("postgres"),
+		reports: reports, tenants: tenants}
+}
+
+// Schedules lists the report schedules of the user.
+func (s *scheduleController) Schedules(ctx context.Context, schema string, userID int64) ([]*Schedule, error) {
+	nq := s.dialect.From(goqu.S(schema).Table("report_schedule")).Select(scheduleColumns...).Where(
+		goqu.Ex{"user_id": userID},
+	).Order(goqu.I("id").Asc()).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	defer metrics.ObserveQuery("schedule", "schedules")()
+	res, err := s.conn.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	st := tenant.SettingsFrom(ctx)
+	list := []*Schedule{}
+	for res.Next() {
+		sc, err := scanSchedule(res, st)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, sc)
+	}
+	return list, res.Err()
+}
+
+// Schedule returns a report schedule of the user.
+func (s *scheduleController) Schedule(ctx context.Context, schema string, userID int64, scheduleID int64) (*Schedule, error) {
+	nq := s.dialect.From(goqu.S(schema).Table("report_schedule")).Select(scheduleColumns...).Where(
+		goqu.Ex{"id": scheduleID, "user_id": userID},
+	).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	return scanSchedule(s.conn.QueryRow(ctx, q, args...), tenant.SettingsFrom(ctx))
+}
+
+// CreateSchedule stores a new report schedule, the first run is due at the next cron tick.
+func (s *scheduleController) CreateSchedule(ctx context.Context, schema string, userID int64, request ScheduleRequest) (*Schedule, error) {
+	scopeRequest(ctx, userID, &request.Request)
+	if request.Timezone == "" {
+		request.Timezone = tenant.SettingsFrom(ctx).Timezone
+	}
+	record, err := scheduleRecord(request, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	record["user_id"] = userID
+	record["created"] = now
+	record["modified"] = now
+	if request.IsActive == nil {
+		record["is_active"] = true
+	}
+	iq := s.dialect.Insert(goqu.S(schema).Table("report_schedule")).Rows(record).Returning("id").Prepared(true)
+	q, args, err := iq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	var id int64
+	if err := s.conn.QueryRow(ctx, q, args...).Scan(&id); err != nil {
+		return nil, err
+	}
+	return s.Schedule(ctx, schema, userID, id)
+}
+
+// UpdateSchedule replaces a report schedule of the user, the next run is computed again.
+func (s *scheduleController) UpdateSchedule(ctx context.Context, schema string, userID int64, scheduleID int64,
+	request ScheduleRequest) (*Schedule, error) {
+
+	scopeRequest(ctx, userID, &request.Request)
+	if request.Timezone == "" {
+		request.Timezone = tenant.SettingsFrom(ctx).Timezone
+	}
+	record, err := scheduleRecord(request, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	record["modified"] = time.Now().UTC()
+	uq := s.dialect.Update(goqu.S(schema).Table("report_schedule")).Set(record).Where(
+		goqu.Ex{"id": scheduleID, "user_id": userID},
+	).Prepared(true)
+	q, args, err := uq.ToSQL()
+	if err != nil {
+		return nil, err
+	}
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	tag, err := s.conn.Exec(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	return s.Schedule(ctx, schema, userID, scheduleID)
+}
+
+// DeleteSchedule removes a report schedule of the user, the runs it already created are kept.
+func (s *scheduleController) DeleteSchedule(ctx context.Context, schema string, userID int64, scheduleID int64) error {
+	dq := s.dialect.Delete(goqu.S(schema).Table("report_schedule")).Where(
+		goqu.Ex{"id": scheduleID, "user_id": userID},
+	).Prepared(true)
+	q, args, err := dq.ToSQL()
+	if err != nil {
+		return err
+	}
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+	tag, err := s.conn.Exec(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// RunDue starts a report run for every active schedule which is due, in every tenant schema.
+func (s *scheduleController) RunDue(ctx context.Context, now time.Time) error {
+	// Only the tenants which applied the schedule migration are considered.
+	res, err := s.conn.Query(ctx, "SELECT table_schema FROM information_schema.tables WHERE table_name = 'report_schedule'")
+	if err != nil {
+		return err
+	}
+	var schemas []string
+	for res.Next() {
+		var schema string
+		if err := res.Scan(&schema); err != nil {
+			res.Close()
+			return err
+		}
+		schemas = append(schemas, schema)
+	}
+	res.Close()
+	if err := res.Err(); err != nil {
+		return err
+	}
+	for _, schema := range schemas {
+		t, ok := s.tenants.Lookup(ctx, schema)
+		if !ok {
+			continue
+		}
+		if err := s.runDue(ctx, t, now); err != nil {
+			s.logger.WithContext(ctx).WithError(err).WithField("schema", schema).Error("Unable to run the due report schedules")
+		}
+	}
+	return nil
+}
+
+// dueRun is a schedule claimed for a run.
+type dueRun struct {
+	id         int64
+	userID     int64
+	reportType string
+	request    Request
+	next       time.Time
+}
+
+// runDue claims the due schedules of the schema and starts their runs. The next run is stored before
+// the report is started, so a schedule fires at most once per tick even if the run can not be started. The
+// schedules which can not be run any more are deactivated with their error, the schedules of the deactivated
+// users are skipped.
+func (s *scheduleController) runDue(ctx context.Context, t *tenant.Tenant, now time.Time) error {
+	schema := t.Schema
+	tbl := goqu.S(schema).Table("report_schedule")
+	sq := s.dialect.From(tbl).Select(
+		"report_schedule.id", "report_schedule.user_id", "report_schedule.report_type", "report_schedule.cron",
+		"report_schedule.timezone", "report_schedule.window", "report_schedule.request",
+	).InnerJoin(goqu.S(schema).Table("auth_user"), goqu.On(goqu.Ex{
+		"auth_user.id": goqu.I("report_schedule.user_id"),
+	})).Where(
+		goqu.Ex{"report_schedule.is_active": true, "auth_user.is_active": true},
+		goqu.C("next_run").Table("report_schedule").Lte(now.UTC()),
+	).ForUpdate(goqu.SkipLocked, goqu.T("report_schedule")).Prepared(true)
+	q, args, err := sq.ToSQL()
+	if err != nil {
+		return err
+	}
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"query": q, "params": args}).Debug("Running ...")
+
+	tx, err := s.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	observe := metrics.ObserveQuery("schedule", "due_schedules")
+	res, err := tx.Query(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	var claims []dueRun
+	// invalid are the errors of the schedules which can not be run.
+	invalid := map[int64]error{}
+	for res.Next() {
+		var (
+			c                      dueRun
+			spec, timezone, window string
+			payload                []byte
+		)
+		if err := res.Scan(&c.id, &c.userID, &c.reportType, &spec, &timezone, &window, &payload); err != nil {
+			res.Close()
+			return err
+		}
+		// The schedule was valid when stored, this only happens after the timezone database changed or after
+		// the table was edited by hand.
+		var (
+			sched cron.Schedule
+			loc   *time.Location
+		)
+		err := json.Unmarshal(payload, &c.request)
+		if err != nil {
+			err = fmt.Errorf("%w: invalid request: %v", helpers.ErrInvalidSchedule, err)
+		} else if sched, loc, err = parseSchedule(spec, timezone); err == nil {
+			c.next = sched.Next(now.In(loc)).UTC()
+			err = applyWindow(&c.request, window, now.In(loc), t.Settings.WeekStart)
+		}
+		if err != nil {
+			s.logger.WithContext(ctx).WithError(err).WithField("schedule_id", c.id).Error("Invalid report schedule, deactivating it")
+			invalid[c.id] = err
+			continue
+		}
+		// The workbook dates are written in the timezone of the schedule.
+		if c.request.Timezone == "" {
+			c.request.Timezone = timezone
+		}
+		claims = append(claims, c)
+	}
+	res.Close()
+	observe()
+	if err := res.Err(); err != nil {
+		return err
+	}
+	for _, c := range claims {
+		uq := s.dialect.Update(tbl).Set(goqu.Record{"next_run": c.next, "last_run": now.UTC()}).Where(
+			goqu.Ex{"id": c.id},
+		).Prepared(true)
+		q, args, err := uq.ToSQL()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, q, args...); err != nil {
+			return err
+		}
+	}
+	for id, scheduleErr := range invalid {
+		uq := s.dialect.Update(tbl).Set(goqu.Record{"is_active": false, "last_error": scheduleErr.Error()}).Where(
+			goqu.Ex{"id": id},
+		).Prepared(true)
+		q, args, err := uq.ToSQL()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, q, args...); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	for _, c := range claims {
+		record := goqu.Record{"last_error": nil}
+		// The stored request already carries the store scope of the schedule owner.
+		d, err := s.reports.Run(WithAllStores(ctx), schema, c.userID, c.reportType, c.request)
+		if err != nil {
+			s.logger.WithContext(ctx).WithError(err).WithField("schedule_id", c.id).Error("Unable to start the scheduled report")
+			record["last_error"] = err.Error()
+		} else {
+			record["last_report_id"] = d.ID
+		}
+		uq := s.dialect.Update(tbl).Set(record).Where(goqu.Ex{"id": c.id}).Prepared(true)
+		q, args, err := uq.ToSQL()
+		if err != nil {
+			return err
+		}
+		if _, err := s.conn.Exec(ctx, q, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scheduleRecord validates the request and returns the columns to store, including the next run.
+func scheduleRecord(request ScheduleRequest, now time.Time) (goqu.Record, error) {
+	if request.Name == "" || request.ReportType == "" {
+		return nil, fmt.Errorf("%w: name and report type are required", helpers.ErrInvalidSchedule)
+	}
+	if request.Timezone == "" {
+		request.Timezone = "UTC"
+	}
+	sched, loc, err := parseSchedule(request.Cron, request.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyWindow(&Request{}, request.Window, now, time.Monday); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(request.Request)
+	if err != nil {
+		return nil, err
+	}
+	record := goqu.Record{
+		"name":        request.Name,
+		"report_type": request.ReportType,
+		"cron":        request.Cron,
+		"timezone":    request.Timezone,
+		"window":      request.Window,
+		"request":     string(payload),
+		"next_run":    sched.Next(now.In(loc)).UTC(),
+	}
+	if request.IsActive != nil {
+		record["is_active"] = *request.IsActive
+	}
+	return record, nil
+}
+
+// parseSchedule parses a standard cron expression and the timezone it is evaluated in.
+func parseSchedule(spec string, timezone string) (cron.Schedule, *time.Location, error) {
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", helpers.ErrInvalidSchedule, err)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", helpers.ErrInvalidSchedule, err)
+	}
+	return sched, loc, nil
+}
+
+// applyWindow sets the visited range of the request relative to now, whole days are taken in the
+// location of now and the weeks start on weekStart. An empty window keeps the range of the request.
+func applyWindow(request *Request, window string, now time.Time, weekStart time.Weekday) error {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var from, to time.Time
+	switch window {
+	case "":
+		return nil
+	case WindowToday:
+		from, to = today, now
+	case WindowYesterday:
+		from, to = today.AddDate(0, 0, -1), today
+	case WindowLastWeek:
+		start := today.AddDate(0, 0, -(int(today.Weekday()-weekStart)+7)%7)
+		from, to = start.AddDate(0, 0, -7), start
+	case WindowLastMonth:
+		first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		from, to = first.AddDate(0, -1, 0), first
+	default:
+		m := windowLastDays.FindStringSubmatch(window)
+		if m == nil {
+			return fmt.Errorf("%w: unknown window %q", helpers.ErrInvalidSchedule, window)
+		}
+		days, err := strconv.Atoi(m[1])
+		if err != nil || days < 1 {
+			return fmt.Errorf("%w: unknown window %q", helpers.ErrInvalidSchedule, window)
+		}
+		from, to = today.AddDate(0, 0, -days), today
+	}
+	request.VisitedFrom = from.UTC()
+	request.VisitedTo = to.UTC()
+	return nil
+}
+
+// scanSchedule scans a row selected with scheduleColumns.
+func scanSchedule(row pgx.Row, st tenant.Settings) (*Schedule, error) {
+	var (
+		sc                Schedule
+		payload           []byte
+		nextRun, lastRun  sql.NullTime
+		lastReportID      sql.NullInt64
+		lastError         sql.NullString
+		created, modified time.Time
+	)
+	err := row.Scan(&sc.ID, &sc.Name, &sc.ReportType, &sc.Cron, &sc.Timezone, &sc.Window, &sc.IsActive, &payload,
+		&nextRun, &lastRun, &lastReportID, &lastError, &created, &modified)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(payload, &sc.Request); err != nil {
+		return nil, err
+	}
+	if nextRun.Valid {
+		sc.NextRun = st.Format(nextRun.Time)
+	}
+	if lastRun.Valid {
+		sc.LastRun = st.Format(lastRun.Time)
+	}
+	sc.LastReportID = lastReportID.Int64
+	sc.LastError = lastError.String
+	sc.Created = st.Format(created)
+	sc.Modified = st.Format(modified)
+	return &sc, nil
+}
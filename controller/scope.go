@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// allStoresKey marks a context whose user may see every store of the tenant.
+type allStoresKey struct{}
+
+// WithAllStores returns a context bypassing the store visibility of the user.
+func WithAllStores(ctx context.Context) context.Context {
+	return context.WithValue(ctx, allStoresKey{}, true)
+}
+
+func hasAllStores(ctx context.Context) bool {
+	all, _ := ctx.Value(allStoresKey{}).(bool)
+	return all
+}
+
+// scopeRequest restricts the request to the stores visible to the user. Users seeing every store keep
+// the scope of the request, so stored requests of schedules and runs keep the scope of their owner.
+func scopeRequest(ctx context.Context, userID int64, request *Request) {
+	if !hasAllStores(ctx) {
+		request.ScopeUserID = userID
+	}
+}
+
+// userStoreQuery selects the (user_id, store_id) assignments, either direct or through a region.
+func (r *reportController) userStoreQuery(schema string) *goqu.SelectDataset {
+	tblUserStore := goqu.S(schema).Table("store_userstore")
+	tblUserRegion := goqu.S(schema).Table("store_userregion")
+	tblRegionStore := goqu.S(schema).Table("store_regionstore")
+
+	return r.dialect.From(tblUserStore).Select("user_id", "store_id").Union(
+		r.dialect.From(tblUserRegion).Select("store_userregion.user_id", "store_regionstore.store_id").InnerJoin(
+			tblRegionStore, goqu.On(goqu.Ex{
+				"store_regionstore.region_id": goqu.I("store_userregion.region_id"),
+			}),
+		),
+	)
+}
+
+// scopeStores selects the ids of the stores visible to the user.
+func (r *reportController) scopeStores(schema string, userID int64) *goqu.SelectDataset {
+	return r.dialect.From(r.userStoreQuery(schema).As("user_store")).Select("store_id").Where(
+		goqu.Ex{"user_id": userID},
+	)
+}
+
+// scopeUsers selects the ids of the users sharing a store with the user, including the user.
+func (r *reportController) scopeUsers(schema string, userID int64) *goqu.SelectDataset {
+	return r.dialect.From(r.userStoreQuery(schema).As("user_store")).Select("user_id").Where(
+		goqu.I("store_id").In(r.scopeStores(schema, userID)),
+	).Union(r.dialect.Select(goqu.Cast(goqu.V(userID), "bigint")))
+}
@@ -0,0 +1,348 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jackc/pgx/v4"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	sheetPhotoSessions = "Photo Sessions"
+	sheetStores        = "Stores"
+	sheetUsers         = "Users"
+	sheetFilters       = "Filters"
+)
+
+// workbookStyles holds the style ids shared by the sheets of a workbook, and the timezone
+// of their dates since Excel dates have none.
+type workbookStyles struct {
+	header int
+	date   int
+	loc    *time.Location
+}
+
+// writeWorkbook writes the photo session, store and user datasets matching the request as a
+// multi-sheet XLSX workbook. The progress is reported as a percentage while the sheets are written,
+// it returns the number of data rows written per sheet.
+func (r *reportController) writeWorkbook(ctx context.Context, schema string, reportType string,
+	request Request, w io.Writer, progress func(percent int)) (map[string]int, error) {
+
+	f := excelize.NewFile()
+	defer f.Close()
+
+	styles := workbookStyles{loc: time.UTC}
+	var err error
+	if request.Timezone != "" {
+		if styles.loc, err = time.LoadLocation(request.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	styles.header, err = f.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Bold: true},
+		Fill: excelize.Fill{Type: "pattern", Color: []string{"#DDEBF7"}, Pattern: 1},
+	})
+	if err != nil {
+		return nil, err
+	}
+	styles.date, err = f.NewStyle(&excelize.Style{NumFmt: 22}) // m/d/yy h:mm
+	if err != nil {
+		return nil, err
+	}
+	if err := f.SetSheetName("Sheet1", sheetPhotoSessions); err != nil {
+		return nil, err
+	}
+	for _, sheet := range []string{sheetStores, sheetUsers, sheetFilters} {
+		if _, err := f.NewSheet(sheet); err != nil {
+			return nil, err
+		}
+	}
+
+	// A repeatable read snapshot keeps the sheets consistent with each other.
+	tx, err := r.conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	counts := map[string]int{}
+	// The photo sessions are the bulk of the workbook, they account for most of the progress.
+	counts[sheetPhotoSessions], err = r.writePhotoSessionSheet(ctx, tx, f, styles, schema, request, func(done, total int) {
+		if total > 0 {
+			progress(5 + done*75/total)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	progress(80)
+	if counts[sheetStores], err = r.writeStoreSheet(ctx, tx, f, styles, schema, request); err != nil {
+		return nil, err
+	}
+	progress(90)
+	if counts[sheetUsers], err = r.writeUserSheet(ctx, tx, f, styles, schema, request); err != nil {
+		return nil, err
+	}
+	progress(95)
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	if err := writeFilterSheet(f, styles, reportType, request); err != nil {
+		return nil, err
+	}
+	f.SetActiveSheet(0)
+	return counts, f.Write(w)
+}
+
+// newSheetStream creates a stream writer with a frozen header row.
+func newSheetStream(f *excelize.File, styles workbookStyles, sheet string, header []string, widths []float64) (*excelize.StreamWriter, error) {
+	sw, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return nil, err
+	}
+	err = sw.SetPanes(&excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"})
+	if err != nil {
+		return nil, err
+	}
+	for i, width := range widths {
+		if err := sw.SetColWidth(i+1, i+1, width); err != nil {
+			return nil, err
+		}
+	}
+	cells := make([]interface{}, len(header))
+	for i, h := range header {
+		cells[i] = excelize.Cell{StyleID: styles.header, Value: h}
+	}
+	return sw, sw.SetRow("A1", cells)
+}
+
+// localTime returns the wall clock time in the location as an UTC time, excelize writes the
+// UTC value of the dates.
+func localTime(t time.Time, loc *time.Location) time.Time {
+	l := t.In(loc)
+	return time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), l.Second(), l.Nanosecond(), time.UTC)
+}
+
+// dateCell returns a typed date cell, empty when the time is not set.
+func dateCell(styles workbookStyles, t sql.NullTime) interface{} {
+	if !t.Valid {
+		return nil
+	}
+	return excelize.Cell{StyleID: styles.date, Value: localTime(t.Time, styles.loc)}
+}
+
+func (r *reportController) writePhotoSessionSheet(ctx context.Context, tx pgx.Tx, f *excelize.File,
+	styles workbookStyles, schema string, request Request, progress func(done, total int)) (int, error) {
+
+	sw, err := newSheetStream(f, styles, sheetPhotoSessions, []string{
+		"Session ID", "Visited On", "Created At", "Store ID", "Store", "User ID", "User",
+		"Category ID", "Category", "Photo Count",
+	}, []float64{38, 18, 18, 10, 30, 10, 20, 12, 20, 12})
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	q, args, err := r.photoSessionQuery(schema, request).Select(goqu.COUNT("photo_photosession.id")).ToSQL()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.QueryRow(ctx, q, args...).Scan(&total); err != nil {
+		return 0, err
+	}
+
+	nq := r.photoSessionQuery(schema, request).Select(photoSessionColumns...).Order(
+		goqu.I("photo_photosession.created_on").Desc(),
+	).Prepared(false)
+	q, args, err = nq.ToSQL()
+	if err != nil {
+		return 0, err
+	}
+	rows := 0
+	err = r.fetchCursor(ctx, tx, "workbook_photo_session", q, args, func(res pgx.Rows) error {
+		p, err := scanPhotoSession(res, tenant.DefaultSettings)
+		if err != nil {
+			return err
+		}
+		rows++
+		if rows%exportBatchSize == 0 {
+			progress(rows, total)
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, rows+1)
+		return sw.SetRow(cell, []interface{}{
+			p.ID, dateCell(styles, p.visitedOn), dateCell(styles, sql.NullTime{Time: p.createdOn, Valid: true}),
+			p.Store.ID, p.Store.Name, p.PhotoTakenBy.ID, p.PhotoTakenBy.Name, p.Category.ID, p.Category.Name,
+			p.PhotoCount,
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rows, sw.Flush()
+}
+
+func (r *reportController) writeStoreSheet(ctx context.Context, tx pgx.Tx, f *excelize.File,
+	styles workbookStyles, schema string, request Request) (int, error) {
+
+	sw, err := newSheetStream(f, styles, sheetStores, []string{
+		"Store ID", "Store", "Store Brand", "Store Channel",
+	}, []float64{10, 30, 20, 20})
+	if err != nil {
+		return 0, err
+	}
+	tblStore := goqu.S(schema).Table("store_store")
+	tblStoreBrand := goqu.S(schema).Table("store_storebrand")
+	tblStoreChannel := goqu.S(schema).Table("store_storetype")
+	nq := r.dialect.From(tblStore).Select(
+		"store_store.id", "store_store.title", "store_storebrand.title", "store_storetype.title",
+	).LeftJoin(
+		tblStoreBrand, goqu.On(goqu.Ex{
+			"store_storebrand.id": goqu.I("store_store.store_brand_id"),
+		}),
+	).LeftJoin(
+		tblStoreChannel, goqu.On(goqu.Ex{
+			"store_storetype.id": goqu.I("store_store.store_type_id"),
+		}),
+	).Where(goqu.Ex{"store_store.is_active": true}).Order(goqu.I("store_store.id").Asc())
+	if len(request.Store) > 0 {
+		nq = nq.Where(goqu.Ex{"store_store.id": request.Store})
+	}
+	if len(request.StoreBrand) > 0 {
+		nq = nq.Where(goqu.Ex{"store_store.store_brand_id": request.StoreBrand})
+	}
+	if len(request.StoreChannel) > 0 {
+		nq = nq.Where(goqu.Ex{"store_store.store_type_id": request.StoreChannel})
+	}
+	if request.ScopeUserID > 0 {
+		nq = nq.Where(goqu.I("store_store.id").In(r.scopeStores(schema, request.ScopeUserID)))
+	}
+	q, args, err := nq.Prepared(false).ToSQL()
+	if err != nil {
+		return 0, err
+	}
+	rows := 0
+	err = r.fetchCursor(ctx, tx, "workbook_store", q, args, func(res pgx.Rows) error {
+		var (
+			id             int
+			title          string
+			brand, channel sql.NullString
+		)
+		if err := res.Scan(&id, &title, &brand, &channel); err != nil {
+			return err
+		}
+		rows++
+		cell, _ := excelize.CoordinatesToCellName(1, rows+1)
+		return sw.SetRow(cell, []interface{}{id, title, brand.String, channel.String})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rows, sw.Flush()
+}
+
+func (r *reportController) writeUserSheet(ctx context.Context, tx pgx.Tx, f *excelize.File,
+	styles workbookStyles, schema string, request Request) (int, error) {
+
+	sw, err := newSheetStream(f, styles, sheetUsers, []string{
+		"User ID", "Username", "First Name", "Last Name", "Email", "Date Joined", "Last Login",
+	}, []float64{10, 20, 20, 20, 30, 18, 18})
+	if err != nil {
+		return 0, err
+	}
+	tblUser := goqu.S(schema).Table("auth_user")
+	nq := r.dialect.From(tblUser).Select(
+		"id", "username", "first_name", "last_name", "email", "date_joined", "last_login",
+	).Where(goqu.Ex{"is_active": true}).Order(goqu.I("id").Asc())
+	if len(request.PhotoTakenBy) > 0 {
+		nq = nq.Where(goqu.Ex{"id": request.PhotoTakenBy})
+	}
+	if request.ScopeUserID > 0 {
+		nq = nq.Where(goqu.I("auth_user.id").In(r.scopeUsers(schema, request.ScopeUserID)))
+	}
+	q, args, err := nq.Prepared(false).ToSQL()
+	if err != nil {
+		return 0, err
+	}
+	rows := 0
+	err = r.fetchCursor(ctx, tx, "workbook_user", q, args, func(res pgx.Rows) error {
+		var (
+			id                                 int
+			username, firstName, lastName, eml string
+			joined                             time.Time
+			lastLogin                          sql.NullTime
+		)
+		if err := res.Scan(&id, &username, &firstName, &lastName, &eml, &joined, &lastLogin); err != nil {
+			return err
+		}
+		rows++
+		cell, _ := excelize.CoordinatesToCellName(1, rows+1)
+		return sw.SetRow(cell, []interface{}{
+			id, username, firstName, lastName, eml,
+			dateCell(styles, sql.NullTime{Time: joined, Valid: true}), dateCell(styles, lastLogin),
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rows, sw.Flush()
+}
+
+// writeFilterSheet echoes the request used to generate the workbook.
+func writeFilterSheet(f *excelize.File, styles workbookStyles, reportType string, request Request) error {
+	// Time values are stored as typed dates by SetSheetRow.
+	dateValue := func(t time.Time) interface{} {
+		if t.Unix() <= 0 {
+			return nil
+		}
+		return localTime(t, styles.loc)
+	}
+	rows := [][]interface{}{
+		{"Filter", "Value"},
+		{"Report Type", reportType},
+		{"Generated At", localTime(time.Now(), styles.loc)},
+		{"Timezone", styles.loc.String()},
+		{"Visited From", dateValue(request.VisitedFrom)},
+		{"Visited To", dateValue(request.VisitedTo)},
+		{"Stores", joinInts(request.Store)},
+		{"Store Brands", joinInts(request.StoreBrand)},
+		{"Store Channels", joinInts(request.StoreChannel)},
+		{"Categories", joinInts(request.Category)},
+		{"Photo Taken By", joinInts(request.PhotoTakenBy)},
+		{"Photo Types", joinInts(request.PhotoType)},
+		{"Sessions", strings.Join(request.SessionID, ",")},
+		{"Session Processing Status", request.SessionProcessingStatus},
+		{"Evidence Progress Status", request.EvidenceProgressStatus},
+		{"Quality Processing Status", request.QualityProcessionStatus},
+	}
+	for i := range rows {
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := f.SetSheetRow(sheetFilters, cell, &rows[i]); err != nil {
+			return err
+		}
+	}
+	if err := f.SetCellStyle(sheetFilters, "A1", "B1", styles.header); err != nil {
+		return err
+	}
+	if err := f.SetColWidth(sheetFilters, "A", "A", 28); err != nil {
+		return err
+	}
+	if err := f.SetColWidth(sheetFilters, "B", "B", 40); err != nil {
+		return err
+	}
+	return f.SetPanes(sheetFilters, &excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"})
+}
+
+// joinInts joins the ids as a comma separated string.
+func joinInts(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/crazi-coder/report-service/controller"
+	"github.com/crazi-coder/report-service/core/config"
+	"github.com/crazi-coder/report-service/core/events"
+	"github.com/crazi-coder/report-service/core/logging"
+	"github.com/crazi-coder/report-service/core/metrics"
+	"github.com/crazi-coder/report-service/core/tracing"
+	"github.com/crazi-coder/report-service/core/utils/libs"
+	"github.com/crazi-coder/report-service/core/worker"
+	"github.com/gocelery/gocelery"
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// Worker is the celery worker Config Object
+type Worker interface {
+	Start(context.Context) error
+}
+
+type celeryWorker struct {
+	conf        *config.Config
+	concurrency int
+	logger      *logrus.Logger
+}
+
+// NewWorker creates a new celery worker consuming the report tasks, the configuration has to be validated
+// by ValidateWorker.
+func NewWorker(ctx context.Context, conf *config.Config) Worker {
+	logger := logrus.StandardLogger()
+	// The level was checked by ValidateWorker.
+	level, _ := logrus.ParseLevel(conf.Log.Level)
+	logging.Configure(logger, level)
+	return &celeryWorker{conf: conf, concurrency: conf.Celery.Concurrency, logger: logger}
+}
+
+func (w celeryWorker) Start(ctx context.Context) error {
+	conf := w.conf
+	grace := conf.ShutdownGracePeriod
+	shutdownTracing, err := tracing.Setup(ctx, tracingConfig(conf.Tracing))
+	if err != nil {
+		w.logger.WithError(err).Error("Failed to set up tracing")
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	psql, err := libs.NewPostgreSQLConnection(ctx, w.logger, 1, int32(w.concurrency)+1, pgConfig(conf.Postgres))
+	if err != nil {
+		w.logger.WithError(err).Error("Failed to create postgres connection")
+		return err
+	}
+	defer psql.Close()
+
+	if conf.Celery.MetricsAddr != "" {
+		if err := metrics.RegisterPool(psql); err != nil {
+			w.logger.WithError(err).Error("Failed to register the pool metrics")
+			return err
+		}
+		stopMetrics, err := serveMetrics(w.logger, conf.Celery.MetricsAddr)
+		if err != nil {
+			w.logger.WithError(err).Error("Failed to start the metrics listener")
+			return err
+		}
+		defer stopMetrics()
+	}
+
+	var rds *redis.Pool
+	if rdsConf := redisConfig(conf.Redis); rdsConf != nil {
+		rds, err = libs.NewRedisPool(ctx, w.logger, w.concurrency, w.concurrency*2, rdsConf)
+		if err != nil {
+			w.logger.WithError(err).Error("Failed to create redis connection")
+			return err
+		}
+		defer rds.Close()
+	}
+
+	store, err := newBlobStore(ctx, conf.Storage)
+	if err != nil {
+		w.logger.WithError(err).Error("Failed to create report storage")
+		return err
+	}
+
+	client, broker, err := newCeleryClient(w.logger, conf.Celery, w.concurrency, rds)
+	if err != nil {
+		w.logger.WithError(err).Error("Failed to create celery client")
+		return err
+	}
+	if rds != nil && conf.Celery.Broker == config.BrokerRedis {
+		go worker.Heartbeat(ctx, rds, w.logger, heartbeatKey(conf.Celery), conf.Celery.HeartbeatInterval)
+	}
+	ctl := controller.NewReportController(ctx, w.logger, psql, worker.NewCeleryQueue(broker), store,
+		events.NewBroker(psql, w.logger))
+	// The running tasks get the grace period to finish after ctx is done, they are queued again after it.
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	worker.RegisterTasks(jobCtx, client, w.logger, ctl.Execute)
+
+	w.logger.WithField("concurrency", w.concurrency).Info("Starting celery worker")
+	client.StartWorker()
+	<-ctx.Done()
+	w.logger.WithField("grace_period", grace.String()).Info("Stopping celery worker")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), grace)
+	defer cancelShutdown()
+	stopCeleryWorker(shutdownCtx, client, cancelJobs)
+	w.logger.Info("Celery worker stopped")
+	return nil
+}
+
+// serveMetrics serves the prometheus metrics of the process on addr, the returned function stops the listener.
+func serveMetrics(logger *logrus.Logger, addr string) (func(), error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.WithError(err).Error("Metrics listener failed")
+		}
+	}()
+	logger.WithField("addr", l.Addr().String()).Info("Serving the metrics")
+	return func() { srv.Close() }, nil
+}
+
+// stopCeleryWorker stops consuming the tasks and waits for the running ones until the context is done,
+// the tasks still running are then cancelled, which queues their reports again.
+func stopCeleryWorker(ctx context.Context, client *gocelery.CeleryClient, cancelJobs context.CancelFunc) {
+	stopped := make(chan struct{})
+	go func() {
+		client.StopWorker()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		cancelJobs()
+		<-stopped
+	}
+}
+
+// newCeleryClient creates a celery client using the shared redis pool as broker and backend,
+// the memory broker keeps the messages in process and is meant for local runs. The broker is
+// returned too, the jobs are published to it.
+func newCeleryClient(logger *logrus.Logger, conf config.Celery, concurrency int,
+	pool *redis.Pool) (*gocelery.CeleryClient, gocelery.CeleryBroker, error) {
+	if conf.Broker == config.BrokerMemory {
+		logger.Warn("Using the in-memory celery broker, tasks are not shared between processes")
+		broker := worker.NewMemoryBroker()
+		client, err := worker.NewCeleryClient(broker, broker, concurrency)
+		return client, broker, err
+	}
+	if pool == nil {
+		return nil, nil, errors.New("celery broker requires redis.host to be configured")
+	}
+	broker := gocelery.NewRedisBroker(pool)
+	broker.QueueName = conf.Queue
+	client, err := worker.NewCeleryClient(broker, gocelery.NewRedisBackend(pool), concurrency)
+	return client, broker, err
+}
+
+// heartbeatKey is the redis key refreshed by the celery workers consuming the queue.
+func heartbeatKey(conf config.Celery) string {
+	return conf.Queue + ":heartbeat"
+}
+
+// celeryDepth returns the length of the celery queue in redis, -1 when it can not be read.
+func celeryDepth(pool *redis.Pool, queue string) func() float64 {
+	return func() float64 {
+		conn := pool.Get()
+		defer conn.Close()
+		n, err := redis.Int(conn.Do("LLEN", queue))
+		if err != nil {
+			return -1
+		}
+		return float64(n)
+	}
+}
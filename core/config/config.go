@@ -0,0 +1,297 @@
+// Package config holds the configuration of the service. It is read from the defaults, then a YAML or TOML
+// file, then the environment and then the command line flags, each source overriding the previous ones.
+//
+// Every setting has a key, e.g. "postgres.host", which is its path in the file and, with the dots replaced by
+// dashes, its flag. The env tag names its environment variable. The secrets have no flag, the command lines
+// are visible to the other processes, and are redacted when the configuration is printed.
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/crazi-coder/report-service/core/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// Config is the configuration of the server and the celery worker.
+type Config struct {
+	Server   Server   `yaml:"server"`
+	Postgres Postgres `yaml:"postgres"`
+	Redis    Redis    `yaml:"redis"`
+	Queue    Queue    `yaml:"queue"`
+	Celery   Celery   `yaml:"celery"`
+	Storage  Storage  `yaml:"storage"`
+	JWT      JWT      `yaml:"jwt"`
+	Auth     Auth     `yaml:"auth"`
+	Tenants  Tenants  `yaml:"tenants"`
+	// Scheduler runs the report schedules, every replica runs it and only the elected leader fires them.
+	Scheduler Scheduler `yaml:"scheduler"`
+	Tracing   Tracing   `yaml:"tracing"`
+	Log       Log       `yaml:"log"`
+	// ShutdownGracePeriod is the time given to the requests and the running reports to finish on shutdown, the
+	// requests get at most half of it.
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period" env:"SHUTDOWN_GRACE_PERIOD"`
+}
+
+// Server is the HTTP server.
+type Server struct {
+	Host        string        `yaml:"host" env:"SERVER_HOST" flag:"host"`
+	Port        string        `yaml:"port" env:"SERVER_PORT" flag:"port"`
+	ReadTimeout time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	// WriteTimeout bounds the regular responses, the streamed exports and events extend it as they write.
+	WriteTimeout       time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	HealthCheckTimeout time.Duration `yaml:"health_check_timeout" env:"HEALTH_CHECK_TIMEOUT"`
+	// MetricsAddr is the address /metrics is served on, apart from the API so it is not public. Empty disables it.
+	MetricsAddr string `yaml:"metrics_addr" env:"SERVER_METRICS_ADDR"`
+}
+
+// Postgres is the database holding the tenant schemas.
+type Postgres struct {
+	Host     string `yaml:"host" env:"PROD_INFIVIZ_DB_SERVER_IP"`
+	Port     int    `yaml:"port" env:"POSTGRES_PORT"`
+	Database string `yaml:"database" env:"PROD_INFIVIZ_DB_NAME"`
+	User     string `yaml:"user" env:"PROD_INFIVIZ_DB_USERNAME"`
+	Password string `yaml:"password" env:"PROD_INFIVIZ_DB_PASSWORD" secret:"true"`
+}
+
+// Redis is optional, it is only connected when Host is set.
+type Redis struct {
+	Host          string `yaml:"host" env:"REDIS_HOST"`
+	Port          int    `yaml:"port" env:"REDIS_PORT"`
+	Password      string `yaml:"password" env:"REDIS_PASSWORD" secret:"true"`
+	Database      int    `yaml:"db" env:"REDIS_DB"`
+	TLS           bool   `yaml:"tls" env:"REDIS_TLS"`
+	TLSSkipVerify bool   `yaml:"tls_skip_verify" env:"REDIS_TLS_SKIP_VERIFY"`
+	MaxIdle       int    `yaml:"max_idle" env:"REDIS_MAX_IDLE"`
+	MaxActive     int    `yaml:"max_active" env:"REDIS_MAX_ACTIVE"`
+}
+
+// Queue selects where the reports are generated, QueueLocal in process or QueueCelery by the celery workers.
+type Queue struct {
+	Backend string `yaml:"backend" env:"REPORT_QUEUE"`
+	// Workers is the number of reports generated in parallel by the local queue.
+	Workers int `yaml:"workers" env:"REPORT_WORKERS"`
+	// Buffer is the number of reports the local queue holds before the new runs wait for a worker.
+	Buffer int `yaml:"buffer" env:"REPORT_QUEUE_BUFFER"`
+}
+
+// Celery is the celery broker, BrokerMemory keeps the messages in process and is meant for local runs.
+type Celery struct {
+	Broker string `yaml:"broker" env:"CELERY_BROKER"`
+	Queue  string `yaml:"queue" env:"CELERY_QUEUE"`
+	// Concurrency is the number of reports processed in parallel by the worker command.
+	Concurrency       int           `yaml:"concurrency" env:"WORKER_CONCURRENCY" flag:"concurrency"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval" env:"WORKER_HEARTBEAT_INTERVAL"`
+	// MetricsAddr is the address the worker command serves /metrics on, empty disables it.
+	MetricsAddr string `yaml:"metrics_addr" env:"WORKER_METRICS_ADDR"`
+}
+
+// Storage is where the report artifacts are kept, StorageLocal on disk or StorageS3 in a bucket.
+type Storage struct {
+	Backend  string `yaml:"backend" env:"STORAGE_BACKEND"`
+	LocalDir string `yaml:"local_dir" env:"STORAGE_LOCAL_DIR"`
+	S3       S3     `yaml:"s3"`
+}
+
+// S3 is a S3 compatible bucket.
+type S3 struct {
+	Endpoint  string `yaml:"endpoint" env:"S3_ENDPOINT"`
+	Region    string `yaml:"region" env:"S3_REGION"`
+	Bucket    string `yaml:"bucket" env:"S3_BUCKET"`
+	AccessKey string `yaml:"access_key" env:"S3_ACCESS_KEY"`
+	SecretKey string `yaml:"secret_key" env:"S3_SECRET_KEY" secret:"true"`
+	UseSSL    bool   `yaml:"use_ssl" env:"S3_USE_SSL"`
+}
+
+// JWT configures the verification of the tokens and, with a secret or a private key, their issuing.
+type JWT struct {
+	// Secret verifies and signs HS256 tokens.
+	Secret        string        `yaml:"secret" env:"JWT_SECRET" secret:"true"`
+	PublicKeyFile string        `yaml:"public_key_file" env:"JWT_PUBLIC_KEY_FILE"`
+	JWKSURL       string        `yaml:"jwks_url" env:"JWT_JWKS_URL"`
+	KeysRefresh   time.Duration `yaml:"keys_refresh" env:"JWT_KEYS_REFRESH"`
+	Issuer        string        `yaml:"issuer" env:"JWT_ISSUER"`
+	Audience      string        `yaml:"audience" env:"JWT_AUDIENCE"`
+	Leeway        time.Duration `yaml:"leeway" env:"JWT_LEEWAY"`
+	// PrivateKeyFile signs the issued tokens, it takes precedence over the secret.
+	PrivateKeyFile string        `yaml:"private_key_file" env:"JWT_PRIVATE_KEY_FILE"`
+	KeyID          string        `yaml:"key_id" env:"JWT_KEY_ID"`
+	AccessTTL      time.Duration `yaml:"access_ttl" env:"JWT_ACCESS_TTL"`
+	RefreshTTL     time.Duration `yaml:"refresh_ttl" env:"JWT_REFRESH_TTL"`
+	// RevocationTTL is how long the revoked tokens are remembered, it has to cover their lifetime.
+	RevocationTTL time.Duration `yaml:"revocation_ttl" env:"JWT_REVOCATION_TTL"`
+}
+
+// Auth configures the passwords and the permissions.
+type Auth struct {
+	PasswordHasher string `yaml:"password_hasher" env:"PASSWORD_HASHER"`
+	// PolicyFile replaces the default RBAC policy when set.
+	PolicyFile string `yaml:"policy_file" env:"RBAC_POLICY_FILE"`
+}
+
+// Tenants configures the tenant registry.
+type Tenants struct {
+	// Table lists the tenants, e.g. "public.tenants", they are the schemas having an auth_user table without it.
+	Table   string        `yaml:"table" env:"TENANT_TABLE"`
+	Refresh time.Duration `yaml:"refresh" env:"TENANT_REFRESH"`
+}
+
+// Scheduler configures the report schedules.
+type Scheduler struct {
+	Enabled bool `yaml:"enabled" env:"SCHEDULER_ENABLED"`
+}
+
+// Tracing configures the OpenTelemetry traces, the OTLP endpoint is read by the exporter from
+// OTEL_EXPORTER_OTLP_ENDPOINT.
+type Tracing struct {
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER"`
+	ServiceName string  `yaml:"service_name" env:"OTEL_SERVICE_NAME"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+}
+
+// Log configures the logs of the server and the worker.
+type Log struct {
+	// Level is a logrus level, e.g. "info" or "debug", the debug logs include the SQL queries.
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+}
+
+// Backends of the settings choosing an implementation.
+const (
+	QueueLocal   = "local"
+	QueueCelery  = "celery"
+	BrokerRedis  = "redis"
+	BrokerMemory = "memory"
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// Default returns the configuration used for the settings which are not set. The connections and the
+// secrets have no default, they have to be configured.
+func Default() Config {
+	return Config{
+		Server: Server{Host: "0.0.0.0", Port: "3001", ReadTimeout: 5 * time.Second, WriteTimeout: 30 * time.Second,
+			HealthCheckTimeout: 2 * time.Second, MetricsAddr: ":9100"},
+		Postgres: Postgres{Port: 5432},
+		Redis:    Redis{Port: 6379, MaxIdle: 3, MaxActive: 10},
+		Queue:    Queue{Backend: QueueLocal, Workers: 2, Buffer: 100},
+		Celery: Celery{Broker: BrokerRedis, Queue: "celery", Concurrency: 2, HeartbeatInterval: 10 * time.Second,
+			MetricsAddr: ":9101"},
+		Storage: Storage{Backend: StorageLocal, LocalDir: filepath.Join(os.TempDir(), "reports"),
+			S3: S3{Endpoint: "s3.amazonaws.com", Bucket: "reports", UseSSL: true}},
+		JWT: JWT{KeysRefresh: 10 * time.Minute, Leeway: 30 * time.Second, AccessTTL: 15 * time.Minute,
+			RefreshTTL: 168 * time.Hour, RevocationTTL: 168 * time.Hour},
+		Auth:                Auth{PasswordHasher: "pbkdf2_sha256"},
+		Tenants:             Tenants{Refresh: 5 * time.Minute},
+		Scheduler:           Scheduler{Enabled: true},
+		Tracing:             Tracing{Exporter: tracing.ExporterNone, ServiceName: "report-service", SampleRatio: 1},
+		Log:                 Log{Level: "info"},
+		ShutdownGracePeriod: 25 * time.Second,
+	}
+}
+
+// Validate checks the settings shared by the server and the worker.
+func (c *Config) Validate() error {
+	var v validation
+	c.validate(&v)
+	return v.err()
+}
+
+func (c *Config) validate(v *validation) {
+	v.required("postgres.host", c.Postgres.Host)
+	v.required("postgres.database", c.Postgres.Database)
+	v.required("postgres.user", c.Postgres.User)
+	v.required("postgres.password", c.Postgres.Password)
+	v.check(c.Postgres.Port > 0, "postgres.port must be positive")
+	v.check(c.Redis.Host == "" || c.Redis.Port > 0, "redis.port must be positive")
+	v.oneOf("celery.broker", c.Celery.Broker, BrokerRedis, BrokerMemory)
+	v.required("celery.queue", c.Celery.Queue)
+	v.oneOf("storage.backend", c.Storage.Backend, StorageLocal, StorageS3)
+	if c.Storage.Backend == StorageS3 {
+		v.required("storage.s3.bucket", c.Storage.S3.Bucket)
+		v.required("storage.s3.access_key", c.Storage.S3.AccessKey)
+		v.required("storage.s3.secret_key", c.Storage.S3.SecretKey)
+	} else {
+		v.required("storage.local_dir", c.Storage.LocalDir)
+	}
+	v.oneOf("tracing.exporter", c.Tracing.Exporter, tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP)
+	v.check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+	_, err := logrus.ParseLevel(c.Log.Level)
+	v.check(err == nil, "log.level must be one of trace, debug, info, warn, error, fatal or panic")
+	v.check(c.ShutdownGracePeriod > 0, "shutdown_grace_period must be positive")
+}
+
+// ValidateServer checks the settings of the server.
+func (c *Config) ValidateServer() error {
+	var v validation
+	c.validate(&v)
+	v.required("server.port", c.Server.Port)
+	v.check(c.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	v.check(c.Server.WriteTimeout > 0, "server.write_timeout must be positive")
+	v.check(c.Server.HealthCheckTimeout > 0, "server.health_check_timeout must be positive")
+	v.oneOf("queue.backend", c.Queue.Backend, QueueLocal, QueueCelery)
+	if c.Queue.Backend == QueueCelery && c.Celery.Broker == BrokerRedis {
+		v.required("redis.host", c.Redis.Host)
+	} else {
+		v.check(c.Queue.Workers > 0, "queue.workers must be positive")
+	}
+	if c.Queue.Backend == QueueLocal {
+		v.check(c.Queue.Buffer > 0, "queue.buffer must be positive")
+	}
+	v.check(c.JWT.Secret != "" || c.JWT.PublicKeyFile != "" || c.JWT.JWKSURL != "",
+		"one of jwt.secret, jwt.public_key_file or jwt.jwks_url is required")
+	v.check(c.JWT.KeysRefresh > 0, "jwt.keys_refresh must be positive")
+	v.check(c.JWT.Leeway >= 0, "jwt.leeway can not be negative")
+	v.check(c.JWT.AccessTTL > 0 && c.JWT.RefreshTTL > 0, "jwt.access_ttl and jwt.refresh_ttl must be positive")
+	// The user revocations are cached for revocation_ttl, the tokens they reject live up to refresh_ttl.
+	v.check(c.JWT.RevocationTTL >= c.JWT.RefreshTTL, "jwt.revocation_ttl must be at least jwt.refresh_ttl")
+	return v.err()
+}
+
+// ValidateWorker checks the settings of the celery worker.
+func (c *Config) ValidateWorker() error {
+	var v validation
+	c.validate(&v)
+	if c.Celery.Broker == BrokerRedis {
+		v.required("redis.host", c.Redis.Host)
+		v.check(c.Celery.HeartbeatInterval > 0, "celery.heartbeat_interval must be positive")
+	}
+	v.check(c.Celery.Concurrency > 0, "celery.concurrency must be positive")
+	return v.err()
+}
+
+// validation collects the problems of the configuration, they are all reported at once.
+type validation []string
+
+func (v *validation) check(ok bool, problem string) {
+	if !ok {
+		*v = append(*v, problem)
+	}
+}
+
+func (v *validation) required(key, value string) {
+	v.check(value != "", key+" is required")
+}
+
+func (v *validation) oneOf(key, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	*v = append(*v, fmt.Sprintf("%s must be one of %s, got %q", key, strings.Join(allowed, ", "), value))
+}
+
+func (v validation) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+func (v validation) Error() string {
+	return "invalid configuration: " + strings.Join(v, "; ")
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv is the environment variable naming the configuration file when no path is given.
+const FileEnv = "REPORT_SERVICE_CONFIG"
+
+// redacted replaces the secrets which are set when the configuration is printed.
+const redacted = "[REDACTED]"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setting is a leaf of the configuration.
+type setting struct {
+	key    string
+	env    string
+	flag   string
+	secret bool
+	value  reflect.Value
+}
+
+// settings returns the leaves of the configuration, in the order of the fields.
+func settings(c *Config) []setting {
+	var all []setting
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			key := prefix + f.Tag.Get("yaml")
+			if f.Type.Kind() == reflect.Struct && f.Type != durationType {
+				walk(v.Field(i), key+".")
+				continue
+			}
+			s := setting{key: key, env: f.Tag.Get("env"), flag: f.Tag.Get("flag"), secret: f.Tag.Get("secret") == "true",
+				value: v.Field(i)}
+			if s.flag == "" && !s.secret {
+				s.flag = strings.NewReplacer(".", "-", "_", "-").Replace(key)
+			}
+			all = append(all, s)
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return all
+}
+
+// set parses the value into the setting.
+func (s setting) set(value string) error {
+	var err error
+	switch {
+	case s.value.Type() == durationType:
+		var d time.Duration
+		if d, err = time.ParseDuration(value); err == nil {
+			s.value.SetInt(int64(d))
+		}
+	case s.value.Kind() == reflect.String:
+		s.value.SetString(value)
+	case s.value.Kind() == reflect.Int:
+		var n int
+		if n, err = strconv.Atoi(value); err == nil {
+			s.value.SetInt(int64(n))
+		}
+	case s.value.Kind() == reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(value); err == nil {
+			s.value.SetBool(b)
+		}
+	case s.value.Kind() == reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(value, 64); err == nil {
+			s.value.SetFloat(f)
+		}
+	default:
+		return fmt.Errorf("unsupported type %s of %s", s.value.Type(), s.key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", s.key, value, err)
+	}
+	return nil
+}
+
+// BindFlags registers a flag for every setting except the secrets, the defaults are shown in the usage.
+func BindFlags(flags *pflag.FlagSet) {
+	def := Default()
+	for _, s := range settings(&def) {
+		if s.flag == "" {
+			continue
+		}
+		usage := "Sets " + s.key
+		if s.env != "" {
+			usage += " (env " + s.env + ")"
+		}
+		switch v := s.value.Interface().(type) {
+		case time.Duration:
+			flags.Duration(s.flag, v, usage)
+		case string:
+			flags.String(s.flag, v, usage)
+		case int:
+			flags.Int(s.flag, v, usage)
+		case bool:
+			flags.Bool(s.flag, v, usage)
+		case float64:
+			flags.Float64(s.flag, v, usage)
+		}
+	}
+}
+
+// Load reads the configuration from the defaults, the file at path, or the one named by FileEnv, the environment
+// and the flags changed on the command line, flags may be nil. The configuration is not validated.
+func Load(path string, flags *pflag.FlagSet) (*Config, error) {
+	c := Default()
+	all := settings(&c)
+	if path == "" {
+		path = os.Getenv(FileEnv)
+	}
+	if path != "" {
+		if err := loadFile(path, all); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range all {
+		if value, ok := os.LookupEnv(s.env); ok && s.env != "" && value != "" {
+			if err := s.set(value); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	if flags != nil {
+		for _, s := range all {
+			if f := flags.Lookup(s.flag); s.flag != "" && f != nil && f.Changed {
+				if err := s.set(f.Value.String()); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return &c, nil
+}
+
+// loadFile reads a YAML or TOML file, by extension. An unknown key is an error so a typo is not silently ignored.
+func loadFile(path string, all []setting) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read the configuration: %w", err)
+	}
+	values := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("unsupported configuration file %s, expected .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	byKey := make(map[string]setting, len(all))
+	for _, s := range all {
+		byKey[s.key] = s
+	}
+	flat := map[string]string{}
+	if err := flatten(values, "", flat); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("%s: unknown key %q", path, key)
+		}
+		if err := s.set(flat[key]); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// flatten turns the nested tables of a file into the dotted keys of the settings.
+func flatten(values map[string]interface{}, prefix string, flat map[string]string) error {
+	for key, value := range values {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if err := flatten(v, prefix+key+".", flat); err != nil {
+				return err
+			}
+		case []interface{}:
+			return fmt.Errorf("unexpected list at %q", prefix+key)
+		case nil:
+		default:
+			flat[prefix+key] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with the secrets which are set replaced.
+func (c *Config) Redacted() *Config {
+	r := *c
+	for _, s := range settings(&r) {
+		if s.secret && s.value.String() != "" {
+			s.value.SetString(redacted)
+		}
+	}
+	return &r
+}
+
+// YAML returns the configuration in the format of the configuration file.
+func (c *Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
@@ -0,0 +1,188 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// Channel is the PostgreSQL notification channel carrying the report events.
+const Channel = "report_events"
+
+// reconnectDelay is the wait time before listening again after the connection was lost.
+const reconnectDelay = 5 * time.Second
+
+// Event is a status transition or a progress update of a report run.
+type Event struct {
+	Schema   string `json:"schema"`
+	ReportID int64  `json:"report_id"`
+	Status   string `json:"status"`
+	Percent  int    `json:"percent"`
+	Message  string `json:"message,omitempty"`
+	// Resync is sent to the subscribers when notifications may have been missed, e.g. after a reconnect,
+	// they have to read the status again.
+	Resync bool `json:"-"`
+}
+
+// Bus publishes the report events and lets the server subscribe to them.
+type Bus interface {
+	Publish(ctx context.Context, e Event) error
+	Subscribe(schema string, reportID int64) (<-chan Event, func())
+}
+
+type subscription struct {
+	schema   string
+	reportID int64
+}
+
+// Broker is a Bus backed by PostgreSQL LISTEN/NOTIFY, so events published by any replica or
+// worker reach the subscribers of every replica.
+type Broker struct {
+	pool   *pgxpool.Pool
+	logger *logrus.Logger
+	mu     sync.Mutex
+	subs   map[subscription]map[chan Event]struct{}
+	closed bool
+}
+
+// NewBroker creates a new event Broker, Listen has to run for the subscribers to receive events.
+func NewBroker(pool *pgxpool.Pool, logger *logrus.Logger) *Broker {
+	return &Broker{pool: pool, logger: logger, subs: map[subscription]map[chan Event]struct{}{}}
+}
+
+// Publish notifies every listening replica about the event.
+func (b *Broker) Publish(ctx context.Context, e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = b.pool.Exec(ctx, "SELECT pg_notify($1, $2)", Channel, string(payload))
+	return err
+}
+
+// Subscribe returns the events of the report, the returned function must be called to unsubscribe.
+func (b *Broker) Subscribe(schema string, reportID int64) (<-chan Event, func()) {
+	key := subscription{schema: schema, reportID: reportID}
+	ch := make(chan Event, 16)
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subs[key] == nil {
+		b.subs[key] = map[chan Event]struct{}{}
+	}
+	b.subs[key][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs[key], ch)
+			if len(b.subs[key]) == 0 {
+				delete(b.subs, key)
+			}
+			b.mu.Unlock()
+		})
+	}
+}
+
+// Close closes the channels of the subscribers, and of the later ones, so the open event streams end. It is
+// called on shutdown, the streams would otherwise hold the server until the grace period is over.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for key, chans := range b.subs {
+		for ch := range chans {
+			close(ch)
+		}
+		delete(b.subs, key)
+	}
+}
+
+// Listen receives the notifications on a dedicated connection until the context is done.
+func (b *Broker) Listen(ctx context.Context) {
+	for {
+		err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		b.logger.WithError(err).Error("Report event listener disconnected")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (b *Broker) listen(ctx context.Context) error {
+	// The listening connection is held forever, so it is not taken from the pool.
+	conn, err := pgx.ConnectConfig(ctx, b.pool.Config().ConnConfig)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{Channel}.Sanitize()); err != nil {
+		return err
+	}
+	// The notifications sent while the connection was down are lost.
+	b.resync()
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		e := Event{}
+		if err := json.Unmarshal([]byte(n.Payload), &e); err != nil {
+			b.logger.WithError(err).Warn("Invalid report event")
+			continue
+		}
+		b.dispatch(e)
+	}
+}
+
+// dispatch hands the event to the subscribers of the report.
+func (b *Broker) dispatch(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[subscription{schema: e.Schema, reportID: e.ReportID}] {
+		deliver(ch, e)
+	}
+}
+
+// resync tells every subscriber to read the status of its report again.
+func (b *Broker) resync() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, chans := range b.subs {
+		for ch := range chans {
+			deliver(ch, Event{Schema: key.schema, ReportID: key.reportID, Resync: true})
+		}
+	}
+}
+
+// deliver hands the event to a subscriber without blocking. A slow subscriber misses its oldest pending event
+// instead, so the last events of a run, the final status in particular, always get through. The caller holds
+// the lock, no other event is sent to the channel meanwhile.
+func deliver(ch chan Event, e Event) {
+	for {
+		select {
+		case ch <- e:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
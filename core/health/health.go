@@ -0,0 +1,88 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Check returns an error when the dependency it checks is not available.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of the checks, the errors are keyed by check name.
+type Result struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Checker runs the readiness checks of the service.
+type Checker struct {
+	timeout time.Duration
+	mu      sync.RWMutex
+	names   []string
+	checks  map[string]Check
+}
+
+// New creates a new Checker, every check has to complete within the timeout.
+func New(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout, checks: map[string]Check{}}
+}
+
+// Add registers a check, a check with the same name is replaced.
+func (h *Checker) Add(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// Run runs the checks concurrently, the service is ready when all of them pass.
+func (h *Checker) Run(ctx context.Context) (Result, bool) {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	h.mu.RLock()
+	names := append([]string(nil), h.names...)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = h.checks[name]
+	}
+	h.mu.RUnlock()
+
+	// A check ignoring the context is reported as timed out, it is not waited for.
+	type outcome struct {
+		i   int
+		err error
+	}
+	done := make(chan outcome, len(checks))
+	for i, check := range checks {
+		go func(i int, check Check) {
+			done <- outcome{i, check(ctx)}
+		}(i, check)
+	}
+	errs := make([]error, len(checks))
+	for i := range errs {
+		errs[i] = context.DeadlineExceeded
+	}
+	for pending := len(checks); pending > 0; pending-- {
+		select {
+		case o := <-done:
+			errs[o.i] = o.err
+		case <-ctx.Done():
+			pending = 0
+		}
+	}
+
+	res := Result{Status: "ok", Checks: map[string]string{}}
+	ready := true
+	for i, name := range names {
+		res.Checks[name] = "ok"
+		if errs[i] != nil {
+			res.Checks[name] = errs[i].Error()
+			res.Status, ready = "unavailable", false
+		}
+	}
+	return res, ready
+}
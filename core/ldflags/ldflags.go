@@ -0,0 +1,32 @@
+// Package ldflags holds the build information, it is set by the linker, e.g.
+//
+//	go build -ldflags "-X github.com/crazi-coder/report-service/core/ldflags.Version=1.4.0"
+package ldflags
+
+import "runtime"
+
+var (
+	// Version is the released version of the service.
+	Version = "dev"
+	// Commit is the git commit the service was built from.
+	Commit = "unknown"
+	// BuildDate is the RFC3339 date of the build.
+	BuildDate = "unknown"
+	// Environment is the deployment the build is meant for, e.g. "production".
+	Environment = "development"
+)
+
+// Info is the build information exposed by the service.
+type Info struct {
+	Version     string `json:"version"`
+	Commit      string `json:"commit"`
+	BuildDate   string `json:"build_date"`
+	Environment string `json:"environment"`
+	GoVersion   string `json:"go_version"`
+}
+
+// BuildInfo returns the build information.
+func BuildInfo() Info {
+	return Info{Version: Version, Commit: Commit, BuildDate: BuildDate, Environment: Environment,
+		GoVersion: runtime.Version()}
+}
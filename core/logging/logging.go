@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader is the header propagating the request id between the services.
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey holds the request id of a context.
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose log lines carry the request id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id of the context, empty if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ContextHook adds the request id of the entry context to the log lines, the context is set with
+// logger.WithContext(ctx).
+type ContextHook struct{}
+
+// Levels returns every level, the request id is added to all the log lines.
+func (ContextHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire adds the request_id field, the entry is a copy owned by the logger.
+func (ContextHook) Fire(entry *logrus.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	if id := RequestID(entry.Context); id != "" {
+		entry.Data["request_id"] = id
+	}
+	return nil
+}
+
+// Configure sets up the logger shared by the server and the worker, the lines are JSON and carry the
+// request id of their context.
+func Configure(logger *logrus.Logger, level logrus.Level) {
+	logger.SetLevel(level)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(ContextHook{})
+}
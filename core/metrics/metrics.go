@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// namespace prefixes every metric of the service.
+const namespace = "report_service"
+
+// The outcomes of the report jobs.
+const (
+	OutcomeCompleted = "completed"
+	OutcomeFailed    = "failed"
+	// OutcomeSkipped is a job whose report was no longer queued, OutcomeCancelled one cancelled while running.
+	OutcomeSkipped   = "skipped"
+	OutcomeCancelled = "cancelled"
+	// OutcomeRequeued is a job interrupted by a shutdown and queued again.
+	OutcomeRequeued = "requeued"
+)
+
+var (
+	// HTTPRequests counts the requests by route template, method, tenant schema and status.
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by route, method, tenant schema and status.",
+	}, []string{"route", "method", "schema", "status"})
+
+	// HTTPDuration is the latency of the requests, with the labels of HTTPRequests.
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by route, method, tenant schema and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "schema", "status"})
+
+	// QueryDuration is the duration of the SQL queries by controller and query name.
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "SQL query duration by controller and query.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"controller", "query"})
+
+	// ReportJobs counts the executed report jobs by outcome.
+	ReportJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "report",
+		Name:      "jobs_total",
+		Help:      "Executed report jobs by outcome.",
+	}, []string{"outcome"})
+)
+
+// ObserveQuery starts measuring a query of the controller, the returned func records its duration.
+func ObserveQuery(controller, query string) func() {
+	start := time.Now()
+	return func() {
+		QueryDuration.WithLabelValues(controller, query).Observe(time.Since(start).Seconds())
+	}
+}
+
+// RegisterQueueDepth exposes the number of report jobs waiting for a worker, depth is called on every scrape.
+func RegisterQueueDepth(depth func() float64) error {
+	return prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "report",
+		Name:      "queue_depth",
+		Help:      "Report jobs waiting for a worker.",
+	}, depth))
+}
+
+// RegisterPool exposes the statistics of the connection pool.
+func RegisterPool(pool *pgxpool.Pool) error {
+	return prometheus.Register(&poolCollector{pool: pool})
+}
+
+var (
+	poolAcquired = prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", "acquired_conns"),
+		"Connections currently in use.", nil, nil)
+	poolIdle = prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", "idle_conns"),
+		"Idle connections.", nil, nil)
+	poolTotal = prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", "total_conns"),
+		"Open connections, including the ones being established.", nil, nil)
+	poolMax = prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", "max_conns"),
+		"Maximum size of the pool.", nil, nil)
+	poolAcquires = prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", "acquires_total"),
+		"Successful connection acquisitions.", nil, nil)
+	poolEmptyAcquires = prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", "empty_acquires_total"),
+		"Acquisitions which had to wait for a connection.", nil, nil)
+	poolWait = prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", "acquire_wait_seconds_total"),
+		"Time spent waiting for a connection.", nil, nil)
+)
+
+// poolCollector reads pgxpool.Pool.Stat() on every scrape.
+type poolCollector struct {
+	pool *pgxpool.Pool
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquired
+	ch <- poolIdle
+	ch <- poolTotal
+	ch <- poolMax
+	ch <- poolAcquires
+	ch <- poolEmptyAcquires
+	ch <- poolWait
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(poolAcquired, prometheus.GaugeValue, float64(s.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdle, prometheus.GaugeValue, float64(s.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotal, prometheus.GaugeValue, float64(s.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMax, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquires, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolEmptyAcquires, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolWait, prometheus.CounterValue, s.AcquireDuration().Seconds())
+}
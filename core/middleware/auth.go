@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/crazi-coder/report-service/core/revocation"
+	"github.com/crazi-coder/report-service/core/tenant"
 	"github.com/crazi-coder/report-service/core/utils"
 	helpers "github.com/crazi-coder/report-service/core/utils/helpers"
 	"github.com/gin-gonic/gin"
@@ -15,11 +18,74 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// jwtAuthMiddleware is an authentication middleware based on JWT
-func AuthMiddleware(conn *pgxpool.Pool, logger *logrus.Logger) func(c *gin.Context) {
+// APIKeyHeader is the header carrying the API key of the machine clients.
+const APIKeyHeader = "X-API-Key"
+
+// APIKey is the identity of a verified API key, it acts as its owner restricted to its scopes.
+type APIKey struct {
+	ID     int64
+	Schema string
+	UserID string
+	Scopes []string
+	// Roles are the current roles of the owner, the scopes are only granted while the roles grant them too.
+	Roles []string
+	// Created is compared to the revocations of the owner, revoking every token of a user revokes its keys too.
+	Created time.Time
+}
+
+// APIKeyStore verifies the API keys.
+type APIKeyStore interface {
+	Verify(ctx context.Context, key string) (*APIKey, error)
+}
+
+// jwtAuthMiddleware is an authentication middleware based on JWT, machine clients authenticate
+// with an API key in the X-API-Key header or the ApiKey Authorization scheme. The requests of an
+// unknown tenant are rejected with 403.
+func AuthMiddleware(conn *pgxpool.Pool, logger *logrus.Logger, verifier *Verifier, revoked revocation.Store,
+	apiKeys APIKeyStore, tenants *tenant.Registry) func(c *gin.Context) {
+
 	resp := helpers.NewResponse()
 	return func(c *gin.Context) {
 		authHeader := c.Request.Header.Get("Authorization")
+		// Split by space
+		parts := strings.SplitN(authHeader, " ", 2)
+		key := c.Request.Header.Get(APIKeyHeader)
+		if key == "" && len(parts) == 2 && strings.ToLower(parts[0]) == "apikey" {
+			key = parts[1]
+		}
+		if key != "" {
+			k, err := apiKeys.Verify(c.Request.Context(), key)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, resp.Error(helpers.ErrCodeUnauthorized, "Unauthorized", err))
+				c.Abort()
+				return
+			}
+			t, ok := tenants.Lookup(c.Request.Context(), k.Schema)
+			if !ok {
+				forbid(c)
+				return
+			}
+			isRevoked, err := revoked.IsRevoked(c.Request.Context(), k.Schema, k.UserID, "", k.Created)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, resp.Error(helpers.ErrCodeServerError,
+					"Has encountered a situation it doesn't know how to handle.", err))
+				c.Abort()
+				return
+			}
+			if isRevoked {
+				c.JSON(http.StatusUnauthorized, resp.Error(helpers.ErrCodeUnauthorized, "API key is revoked.",
+					helpers.ErrInvalidAPIKey))
+				c.Abort()
+				return
+			}
+			if active(c, conn, resp, t, k.UserID) {
+				c.Set(utils.CtxRoles, k.Roles)
+				c.Set(utils.CtxScopes, k.Scopes)
+				c.Next()
+			}
+			return
+		}
+
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized,
 				resp.Error(helpers.ErrCodeUnauthorized, "Authorization header is required.",
@@ -27,8 +93,6 @@ func AuthMiddleware(conn *pgxpool.Pool, logger *logrus.Logger) func(c *gin.Conte
 			c.Abort()
 			return
 		}
-		// Split by space
-		parts := strings.SplitN(authHeader, " ", 2)
 		if !(len(parts) == 2 && strings.ToLower(parts[0]) == "bearer") {
 			c.JSON(http.StatusUnauthorized,
 				resp.Error(helpers.ErrCodeUnauthorized, "Authorization header prefix missing.",
@@ -38,33 +102,68 @@ func AuthMiddleware(conn *pgxpool.Pool, logger *logrus.Logger) func(c *gin.Conte
 		}
 
 		// parts[1] is the obtained tokenString. We use the previously defined function to parse JWT to parse it
-		mc, err := ParseToken(parts[1])
+		mc, err := verifier.ParseToken(parts[1])
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, resp.Error(helpers.ErrCodeUnauthorized, "Unauthorized", err))
 			c.Abort()
 			return
 		}
-		logger.Info("The token Values", mc)
-		var userID string
-		q := `SELECT id FROM "%s"."auth_user" WHERE id=$1 AND is_active=$2`
-		sql := fmt.Sprintf(q, mc.Schema)
-		err = conn.QueryRow(context.Background(), sql, mc.UserID, true).Scan(
-			&userID)
-		switch err {
-		case nil:
-			c.Set(utils.CtxUserID, userID)
-			c.Set("user_roles", mc.UserRole)
-			c.Set(utils.CtxSchema, mc.Schema)
-		case pgx.ErrNoRows:
-			c.JSON(http.StatusUnauthorized, resp.Error(helpers.ErrCodeUnauthorized, "Account is inactive.", err))
+		if mc.TokenType != "" && mc.TokenType != TokenAccess {
+			c.JSON(http.StatusUnauthorized, resp.Error(helpers.ErrCodeUnauthorized, "Unauthorized",
+				errors.New("not an access token")))
 			c.Abort()
-		default:
+			return
+		}
+		t, ok := tenants.Lookup(c.Request.Context(), mc.Schema)
+		if !ok {
+			forbid(c)
+			return
+		}
+		var issuedAt time.Time
+		if mc.IssuedAt != nil {
+			issuedAt = mc.IssuedAt.Time
+		}
+		isRevoked, err := revoked.IsRevoked(c.Request.Context(), mc.Schema, mc.UserID, mc.ID, issuedAt)
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, resp.Error(helpers.ErrCodeServerError,
 				"Has encountered a situation it doesn't know how to handle.", err))
 			c.Abort()
+			return
 		}
+		if isRevoked {
+			c.JSON(http.StatusUnauthorized, resp.Error(helpers.ErrCodeUnauthorized, "Token is revoked.",
+				errors.New("revoked token")))
+			c.Abort()
+			return
+		}
+		if active(c, conn, resp, t, mc.UserID) {
+			c.Set(utils.CtxRoles, mc.UserRole)
+			c.Set(utils.CtxTokenID, mc.ID)
+			c.Set(utils.CtxTokenExpiry, mc.ExpiresAt.Time)
+			c.Next() // Subsequent processing
+		}
+	}
+}
 
-		c.Next() // Subsequent processing
-		
+// active sets the user and tenant of the request when the user is active, the request is aborted otherwise.
+func active(c *gin.Context, conn *pgxpool.Pool, resp helpers.Response, t *tenant.Tenant, uid string) bool {
+	var userID string
+	q := `SELECT id FROM %s WHERE id=$1 AND is_active=$2`
+	sql := fmt.Sprintf(q, pgx.Identifier{t.Schema, "auth_user"}.Sanitize())
+	err := conn.QueryRow(context.Background(), sql, uid, true).Scan(
+		&userID)
+	switch err {
+	case nil:
+		c.Set(utils.CtxUserID, userID)
+		c.Set(utils.CtxTenant, t)
+		return true
+	case pgx.ErrNoRows:
+		c.JSON(http.StatusUnauthorized, resp.Error(helpers.ErrCodeUnauthorized, "Account is inactive.", err))
+		c.Abort()
+	default:
+		c.JSON(http.StatusUnauthorized, resp.Error(helpers.ErrCodeServerError,
+			"Has encountered a situation it doesn't know how to handle.", err))
+		c.Abort()
 	}
+	return false
 }
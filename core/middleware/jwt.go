@@ -2,15 +2,30 @@ package middleware
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
-	helpers "github.com/crazi-coder/report-service/core/utils/helpers"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 )
 
-var jwtSecret = []byte(helpers.GetEnv("JWT_SECRET", "lqEjTETjq0vETXloAKJcFKlGSan9OgPVaX3LYBnwJPNhNGFPEfWUjadpmkyyG1sG"))
+// minKeyRefresh limits the key reloads triggered by tokens signed with an unknown kid.
+const minKeyRefresh = time.Minute
+
+const (
+	// TokenAccess is the type of the tokens accepted by the AuthMiddleware.
+	TokenAccess = "access"
+	// TokenRefresh is the type of the tokens used to obtain a new access token.
+	TokenRefresh = "refresh"
+)
+
+// ErrNoSigningKey is returned by NewSigner when the service is not configured to issue tokens.
+var ErrNoSigningKey = errors.New("no JWT signing key configured")
 
 // JWTClaims custom declaration structure and embedded JWT StandardClaims
 // jwt package comes with jwt Standardclaims contains only official fields
@@ -20,44 +35,252 @@ type JWTClaims struct {
 	UserID   string   `json:"id"`
 	UserRole []string `json:"roles"`
 	Schema   string   `json:"uk"`
+	// TokenType is empty for the tokens of the auth service, they are access tokens.
+	TokenType string `json:"token_type,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// parseToken parsing JWT
-func ParseToken(tokenString string) (*JWTClaims, error) {
-	// Parse token
-	claims := &JWTClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (i interface{}, err error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("there's an error with the signing method")
+// VerifierConfig configures the keys and claims accepted by the Verifier.
+type VerifierConfig struct {
+	// Secret enables HS256 tokens, it is disabled when empty.
+	Secret []byte
+	// PublicKeyFile is a PEM file of RSA or ECDSA public keys or certificates.
+	PublicKeyFile string
+	// JWKSURL is the JWKS document of the auth service.
+	JWKSURL string
+	// Refresh is the interval the keys are reloaded at.
+	Refresh  time.Duration
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+}
+
+// Verifier validates the JWT signed with a shared secret (HS256) or the public keys of the
+// auth service (RS256, ES256). The public keys are selected by the kid header and reloaded
+// periodically, so the auth service can rotate its keys.
+type Verifier struct {
+	conf    VerifierConfig
+	logger  *logrus.Logger
+	parser  *jwt.Parser
+	mu      sync.RWMutex
+	keys    map[string]interface{}
+	loaded  time.Time
+	loading sync.Mutex
+	// tried is the last reload triggered by an unknown kid, it is guarded by loading.
+	tried time.Time
+}
+
+// NewVerifier creates a new Verifier, the keys are loaded before returning.
+func NewVerifier(ctx context.Context, logger *logrus.Logger, conf VerifierConfig) (*Verifier, error) {
+	methods := []string{}
+	if len(conf.Secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if conf.PublicKeyFile != "" || conf.JWKSURL != "" {
+		methods = append(methods, jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg())
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no JWT secret, public key file or JWKS url configured")
+	}
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithLeeway(conf.Leeway)}
+	if conf.Issuer != "" {
+		options = append(options, jwt.WithIssuer(conf.Issuer))
+	}
+	if conf.Audience != "" {
+		options = append(options, jwt.WithAudience(conf.Audience))
+	}
+	v := &Verifier{conf: conf, logger: logger, parser: jwt.NewParser(options...), keys: map[string]interface{}{}}
+	if err := v.reload(ctx); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Start reloads the public keys until the context is done, the current keys are kept when it fails.
+func (v *Verifier) Start(ctx context.Context) {
+	if v.conf.Refresh <= 0 || (v.conf.PublicKeyFile == "" && v.conf.JWKSURL == "") {
+		return
+	}
+	ticker := time.NewTicker(v.conf.Refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := v.reload(ctx); err != nil {
+				v.logger.WithError(err).Error("Unable to reload the JWT keys")
+			}
 		}
-		return jwtSecret, nil
-	})
+	}
+}
+
+// ParseToken parsing JWT
+func (v *Verifier) ParseToken(tokenString string) (*JWTClaims, error) {
+	claims := &JWTClaims{}
+	token, err := v.parser.ParseWithClaims(tokenString, claims, v.key)
 	if err != nil {
 		return nil, err
 	}
-	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid { // Verification token
-		return claims, nil
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	// The parser only validates exp when it is present.
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: exp", jwt.ErrTokenRequiredClaimMissing)
 	}
-	return nil, errors.New("invalid token")
+	return claims, nil
 }
 
-func CreateToken(ctx context.Context, UserID string, UserGroup []string, Schema string, domain string) (string, error) {
+// key returns the verification key of the token.
+func (v *Verifier) key(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return v.conf.Secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := v.lookup(kid); ok {
+		return key, nil
+	}
+	// The auth service may have rotated its keys since the last refresh.
+	if err := v.reloadStale(context.Background()); err != nil {
+		v.logger.WithError(err).Error("Unable to reload the JWT keys")
+	}
+	if key, ok := v.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// reloadStale reloads the keys unless they were loaded, or a reload was tried, less than minKeyRefresh ago.
+// The check is made under the loading lock, so the concurrent tokens of an unknown kid wait for a single
+// JWKS fetch instead of running one each.
+func (v *Verifier) reloadStale(ctx context.Context) error {
+	v.loading.Lock()
+	defer v.loading.Unlock()
+	v.mu.RLock()
+	stale := time.Since(v.loaded) > minKeyRefresh
+	v.mu.RUnlock()
+	if !stale || time.Since(v.tried) <= minKeyRefresh {
+		return nil
+	}
+	v.tried = time.Now()
+	return v.load(ctx)
+}
+
+// lookup returns the key with the kid, keys loaded without a kid match every kid.
+func (v *Verifier) lookup(kid string) (interface{}, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, true
+	}
+	key, ok := v.keys[""]
+	return key, ok
+}
+
+// reload loads the keys of the PEM file and the JWKS document.
+func (v *Verifier) reload(ctx context.Context) error {
+	v.loading.Lock()
+	defer v.loading.Unlock()
+	return v.load(ctx)
+}
+
+func (v *Verifier) load(ctx context.Context) error {
+	keys := map[string]interface{}{}
+	if v.conf.PublicKeyFile != "" {
+		if err := loadPEMKeys(v.conf.PublicKeyFile, keys); err != nil {
+			return err
+		}
+	}
+	if v.conf.JWKSURL != "" {
+		if err := loadJWKS(ctx, v.conf.JWKSURL, keys); err != nil {
+			return err
+		}
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.loaded = time.Now()
+	v.mu.Unlock()
+	v.logger.WithField("keys", len(keys)).Debug("JWT keys loaded")
+	return nil
+}
+
+// SignerConfig configures the tokens issued by the service.
+type SignerConfig struct {
+	// Secret signs HS256 tokens when no private key is configured.
+	Secret []byte
+	// PrivateKeyFile is a PEM RSA or ECDSA private key signing RS256 or ES256 tokens.
+	PrivateKeyFile string
+	// KeyID is set as the kid header, so the verifiers can select the public key.
+	KeyID      string
+	Issuer     string
+	Audience   string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// Signer issues the access and refresh tokens.
+type Signer struct {
+	conf   SignerConfig
+	method jwt.SigningMethod
+	key    interface{}
+}
+
+// NewSigner creates a new Signer, ErrNoSigningKey is returned when neither a private key nor a secret is configured.
+func NewSigner(conf SignerConfig) (*Signer, error) {
+	if conf.PrivateKeyFile != "" {
+		key, err := loadPrivateKey(conf.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PrivateKey:
+			return &Signer{conf: conf, method: jwt.SigningMethodRS256, key: key}, nil
+		case *ecdsa.PrivateKey:
+			return &Signer{conf: conf, method: jwt.SigningMethodES256, key: key}, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if len(conf.Secret) > 0 {
+		return &Signer{conf: conf, method: jwt.SigningMethodHS256, key: conf.Secret}, nil
+	}
+	return nil, ErrNoSigningKey
+}
+
+// CreateToken signs a token of the given type for the user, the claims of the token are returned along with it.
+func (s *Signer) CreateToken(ctx context.Context, userID string, roles []string, schema string,
+	tokenType string) (string, *JWTClaims, error) {
+
+	ttl := s.conf.AccessTTL
+	if tokenType == TokenRefresh {
+		ttl = s.conf.RefreshTTL
+	}
+	now := time.Now()
 	st := jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		NotBefore: jwt.NewNumericDate(time.Now()),
-		Issuer:    "Infilect Pvt Ltd",
-		Subject:   "AuthToken",
-		ID:        "1298JUW",
-		Audience:  []string{domain},
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Issuer:    s.conf.Issuer,
+		Subject:   userID,
+		ID:        uuid.NewString(),
+	}
+	if s.conf.Audience != "" {
+		st.Audience = []string{s.conf.Audience}
 	}
 	claims := JWTClaims{
-		UserID:           UserID,
-		UserRole:         UserGroup,
-		Schema:           Schema,
+		UserID:           userID,
+		UserRole:         roles,
+		Schema:           schema,
+		TokenType:        tokenType,
 		RegisteredClaims: st,
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	token := jwt.NewWithClaims(s.method, claims)
+	if s.conf.KeyID != "" {
+		token.Header["kid"] = s.conf.KeyID
+	}
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, &claims, nil
 }
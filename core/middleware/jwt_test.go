@@ -0,0 +1,247 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// jwksServer serves the public keys of its kids, it counts the fetches.
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches atomic.Int32
+}
+
+func newJWKSServer(t *testing.T, kids ...string) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: map[string]*rsa.PrivateKey{}}
+	for _, kid := range kids {
+		s.add(t, kid)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		doc := struct {
+			Keys []jwk `json:"keys"`
+		}{}
+		for kid, key := range s.keys {
+			doc.Keys = append(doc.Keys, jwk{
+				Kty: "RSA", Kid: kid, Use: "sig",
+				N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return key
+}
+
+// add generates the key of the kid, it is served from the next fetch.
+func (s *jwksServer) add(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key := newRSAKey(t)
+	s.mu.Lock()
+	s.keys[kid] = key
+	s.mu.Unlock()
+	return key
+}
+
+func (s *jwksServer) key(kid string) *rsa.PrivateKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[kid]
+}
+
+func newTestVerifier(t *testing.T, conf VerifierConfig) *Verifier {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	v, err := NewVerifier(context.Background(), logger, conf)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	return v
+}
+
+func validClaims() JWTClaims {
+	now := time.Now()
+	return JWTClaims{UserID: "7", Schema: "tenant_a", RegisteredClaims: jwt.RegisteredClaims{
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+	}}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	return signed
+}
+
+func TestVerifierParseToken(t *testing.T) {
+	jwks := newJWKSServer(t, "current")
+	secret := []byte("shared secret")
+	v := newTestVerifier(t, VerifierConfig{Secret: secret, JWKSURL: jwks.URL})
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(&jwks.key("current").PublicKey)})
+
+	noExp := validClaims()
+	noExp.ExpiresAt = nil
+	expired := validClaims()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256 of the JWKS", sign(t, jwt.SigningMethodRS256, "current", jwks.key("current"), validClaims()), true},
+		{"HS256 of the secret", sign(t, jwt.SigningMethodHS256, "", secret, validClaims()), true},
+		// The public key is known to everybody, it must not be accepted as an HMAC secret.
+		{"HS256 signed with the RSA public key", sign(t, jwt.SigningMethodHS256, "current", publicPEM, validClaims()), false},
+		{"HS256 signed with the RSA modulus", sign(t, jwt.SigningMethodHS256, "current",
+			jwks.key("current").N.Bytes(), validClaims()), false},
+		{"none algorithm", sign(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, validClaims()), false},
+		{"missing exp", sign(t, jwt.SigningMethodRS256, "current", jwks.key("current"), noExp), false},
+		{"expired", sign(t, jwt.SigningMethodRS256, "current", jwks.key("current"), expired), false},
+		{"kid not in the JWKS", sign(t, jwt.SigningMethodRS256, "unknown", newRSAKey(t), validClaims()), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.ParseToken(tt.token)
+			if tt.ok && err != nil {
+				t.Fatalf("ParseToken: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("ParseToken accepted the token, claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifierRejectsHS256WithoutSecret(t *testing.T) {
+	jwks := newJWKSServer(t, "current")
+	v := newTestVerifier(t, VerifierConfig{JWKSURL: jwks.URL})
+	token := sign(t, jwt.SigningMethodHS256, "current", jwks.key("current").N.Bytes(), validClaims())
+	if _, err := v.ParseToken(token); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Errorf("ParseToken error = %v, want %v", err, jwt.ErrTokenSignatureInvalid)
+	}
+}
+
+func TestVerifierMissingExpWithSecret(t *testing.T) {
+	secret := []byte("shared secret")
+	v := newTestVerifier(t, VerifierConfig{Secret: secret})
+	claims := validClaims()
+	claims.ExpiresAt = nil
+	if _, err := v.ParseToken(sign(t, jwt.SigningMethodHS256, "", secret, claims)); !errors.Is(err, jwt.ErrTokenRequiredClaimMissing) {
+		t.Errorf("ParseToken error = %v, want %v", err, jwt.ErrTokenRequiredClaimMissing)
+	}
+}
+
+// makeStale backdates the last load and reload attempt of the keys.
+func makeStale(v *Verifier) {
+	v.loading.Lock()
+	v.tried = time.Time{}
+	v.loading.Unlock()
+	v.mu.Lock()
+	v.loaded = time.Now().Add(-2 * minKeyRefresh)
+	v.mu.Unlock()
+}
+
+func TestVerifierRotatedKey(t *testing.T) {
+	jwks := newJWKSServer(t, "old")
+	v := newTestVerifier(t, VerifierConfig{JWKSURL: jwks.URL})
+	token := sign(t, jwt.SigningMethodRS256, "new", jwks.add(t, "new"), validClaims())
+
+	// The keys were just loaded, an unknown kid does not fetch them again.
+	if _, err := v.ParseToken(token); err == nil {
+		t.Fatal("ParseToken accepted a kid missing from the loaded keys")
+	}
+	if n := jwks.fetches.Load(); n != 1 {
+		t.Fatalf("fetches = %d, want 1", n)
+	}
+
+	makeStale(v)
+	if _, err := v.ParseToken(token); err != nil {
+		t.Fatalf("ParseToken with the rotated key: %v", err)
+	}
+	if n := jwks.fetches.Load(); n != 2 {
+		t.Fatalf("fetches = %d, want 2", n)
+	}
+
+	// A kid still unknown after the reload does not fetch again until minKeyRefresh passed.
+	unknown := sign(t, jwt.SigningMethodRS256, "unknown", jwks.key("new"), validClaims())
+	for i := 0; i < 3; i++ {
+		if _, err := v.ParseToken(unknown); err == nil {
+			t.Fatal("ParseToken accepted an unknown kid")
+		}
+	}
+	if n := jwks.fetches.Load(); n != 2 {
+		t.Errorf("fetches = %d, want 2", n)
+	}
+}
+
+// TestVerifierReloadStaleConcurrent is meant for -race: the tokens of an unknown kid arriving together share a
+// single JWKS fetch.
+func TestVerifierReloadStaleConcurrent(t *testing.T) {
+	jwks := newJWKSServer(t, "old")
+	v := newTestVerifier(t, VerifierConfig{JWKSURL: jwks.URL})
+	token := sign(t, jwt.SigningMethodRS256, "new", jwks.add(t, "new"), validClaims())
+	makeStale(v)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := v.ParseToken(token)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("ParseToken: %v", err)
+		}
+	}
+	if n := jwks.fetches.Load(); n != 2 {
+		t.Errorf("fetches = %d, want 2, the initial load and a single reload", n)
+	}
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/crazi-coder/report-service/core/tenant"
+	helpers "github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/gin-gonic/gin"
+)
+
+// Localize applies the regional settings of the tenant to the request context, the timezone, locale,
+// date_format and week_start query parameters override them. It runs after the AuthMiddleware.
+func Localize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		settings := tenant.DefaultSettings
+		if t := tenant.FromContext(c); t != nil {
+			settings = t.Settings
+		}
+		settings, err := settings.Override(c.Query("timezone"), c.Query("locale"), c.Query("date_format"),
+			c.Query("week_start"))
+		if err != nil {
+			resp := helpers.NewResponse()
+			c.AbortWithStatusJSON(http.StatusBadRequest,
+				resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid regional settings", err))
+			return
+		}
+		if settings.Locale != "" {
+			c.Header("Content-Language", settings.Locale)
+		}
+		c.Request = c.Request.WithContext(tenant.WithSettings(c.Request.Context(), settings))
+		c.Next()
+	}
+}
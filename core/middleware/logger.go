@@ -1,19 +1,25 @@
 package middleware
 
 import (
-	"encoding/json"
-	"fmt"
 	"time"
 
+	"github.com/crazi-coder/report-service/core/logging"
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/crazi-coder/report-service/core/utils"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 )
 
-type LogFormatterParams struct {
+// maxRequestIDLength bounds the request ids accepted from the clients.
+const maxRequestIDLength = 128
 
+type LogFormatterParams struct {
+	// RequestID is the X-Request-ID of the request.
+	RequestID string `json:"request_id"`
 	// StatusCode is HTTP response code.
 	StatusCode int `json:"status_code"`
-	// Latency is how much time the server cost to process a certain request.
+	// Latency is how much time the server cost to process a certain request, in milliseconds.
 	Latency int64 `json:"latency"`
 	// ClientIP equals Context's ClientIP method.
 	ClientIP string `json:"client_ip"`
@@ -23,38 +29,90 @@ type LogFormatterParams struct {
 	Path string `json:"path"`
 	// ErrorMessage is set if error has occurred in processing the request.
 	ErrorMessage string `json:"error_message"`
-	// isTerm shows whether gin's output descriptor refers to a terminal.
 	// BodySize is the size of the Response Body
-	BodySize int    `json:"body_size"`
-	User     string `json:"user_id"`
-	// Keys are the keys set on the request's context.
-	Keys map[string]any `json:"keys,omitempty"`
+	BodySize int `json:"body_size"`
+	// Schema is the schema of the tenant, empty if the request is not authenticated.
+	Schema string `json:"schema"`
+	User   string `json:"user_id"`
 }
 
-var formatJSON = func(log LogFormatterParams) string {
-	logline, _ := json.Marshal(log)
-	return fmt.Sprintf("%s\n", logline)
+// Fields returns the params as log fields.
+func (p LogFormatterParams) Fields() logrus.Fields {
+	return logrus.Fields{
+		"request_id":    p.RequestID,
+		"status_code":   p.StatusCode,
+		"latency":       p.Latency,
+		"client_ip":     p.ClientIP,
+		"method":        p.Method,
+		"path":          p.Path,
+		"error_message": p.ErrorMessage,
+		"body_size":     p.BodySize,
+		"schema":        p.Schema,
+		"user_id":       p.User,
+	}
 }
 
-// LoggerWithConfig instance a Logger middleware with config.
+// RequestID propagates the X-Request-ID header of the request, or generates one, into the request context
+// and the response headers.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(logging.RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Header(logging.RequestIDHeader, id)
+		c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), id))
+		c.Next()
+	}
+}
+
+// validRequestID accepts the ids made of printable ASCII characters, so they can not forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// LoggerWithConfig instance a Logger middleware with config, it has to run after RequestID.
 func LoggerWithConfig(logger *logrus.Logger) func(c *gin.Context) {
 
 	return func(c *gin.Context) {
-		start := time.Now().UnixNano() / int64(time.Millisecond)
+		start := time.Now()
 		path := c.Request.URL.Path
 		// Process request
 		c.Next()
-		end := time.Now().UnixNano() / int64(time.Millisecond)
 		param := LogFormatterParams{}
 		// Stop timer
-		param.Latency = end - start
+		param.Latency = time.Since(start).Milliseconds()
+		param.RequestID = logging.RequestID(c.Request.Context())
 		param.ClientIP = c.ClientIP()
 		param.Method = c.Request.Method
 		param.StatusCode = c.Writer.Status()
 		param.ErrorMessage = c.Errors.ByType(gin.ErrorTypePrivate).String()
-		param.BodySize = c.Writer.Size()
-		param.User = c.GetString("user_id")
+		// The size is -1 when nothing was written.
+		if size := c.Writer.Size(); size > 0 {
+			param.BodySize = size
+		}
+		param.User = c.GetString(utils.CtxUserID)
+		if t := tenant.FromContext(c); t != nil {
+			param.Schema = t.Schema
+		}
 		param.Path = path
-		//fmt.Fprint(os.Stdout, formatJSON(param))
+
+		entry := logger.WithFields(param.Fields())
+		switch {
+		case param.StatusCode >= 500:
+			entry.Error("Request served")
+		case param.StatusCode >= 400:
+			entry.Warn("Request served")
+		default:
+			entry.Info("Request served")
+		}
 	}
 }
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/crazi-coder/report-service/core/metrics"
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics records the count and latency of the requests. They are labeled with the route template,
+// so the ids in the paths do not create new series.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		schema := ""
+		if t := tenant.FromContext(c); t != nil {
+			schema = t.Schema
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		metrics.HTTPRequests.WithLabelValues(route, c.Request.Method, schema, status).Inc()
+		metrics.HTTPDuration.WithLabelValues(route, c.Request.Method, schema, status).Observe(time.Since(start).Seconds())
+	}
+}
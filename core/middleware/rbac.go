@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/crazi-coder/report-service/core/utils"
+	helpers "github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/gin-gonic/gin"
+)
+
+// Permission is an action a role may be granted.
+type Permission string
+
+const (
+	// PermAll grants every permission.
+	PermAll Permission = "*"
+	// PermViewFilters allows listing the stores, categories, users and photo types.
+	PermViewFilters Permission = "filters:view"
+	// PermViewSessions allows listing the photo sessions.
+	PermViewSessions Permission = "sessions:view"
+	// PermExportSessions allows the CSV export of the photo sessions.
+	PermExportSessions Permission = "sessions:export"
+	// PermRunReports allows starting, cancelling and retrying report runs.
+	PermRunReports Permission = "reports:run"
+	// PermViewDownloads allows listing and downloading the own report runs.
+	PermViewDownloads Permission = "downloads:view"
+	// PermViewAllDownloads allows listing the report runs of every user of the tenant.
+	PermViewAllDownloads Permission = "downloads:view_all"
+	// PermManageSchedules allows managing the own report schedules.
+	PermManageSchedules Permission = "schedules:manage"
+	// PermViewAllStores bypasses the store assignments of the user.
+	PermViewAllStores Permission = "stores:view_all"
+	// PermRevokeTokens allows revoking every token of another user of the tenant.
+	PermRevokeTokens Permission = "tokens:revoke"
+	// PermManageAPIKeys allows managing the own API keys.
+	PermManageAPIKeys Permission = "api_keys:manage"
+)
+
+// Permissions lists the known permissions, the scopes of the API keys must be one of them.
+var Permissions = []Permission{
+	PermAll, PermViewFilters, PermViewSessions, PermExportSessions, PermRunReports, PermViewDownloads,
+	PermViewAllDownloads, PermManageSchedules, PermViewAllStores, PermRevokeTokens, PermManageAPIKeys,
+}
+
+// Policy maps the JWT roles to the permissions they grant.
+type Policy map[string][]Permission
+
+// DefaultPolicy is used when no RBAC_POLICY_FILE is configured.
+var DefaultPolicy = Policy{
+	utils.RoleAdmin: {PermAll},
+	"manager": {
+		PermViewFilters, PermViewSessions, PermExportSessions, PermRunReports,
+		PermViewDownloads, PermViewAllDownloads, PermManageSchedules,
+	},
+	"analyst": {
+		PermViewFilters, PermViewSessions, PermExportSessions, PermRunReports,
+		PermViewDownloads, PermManageSchedules,
+	},
+	"viewer": {PermViewFilters, PermViewSessions},
+}
+
+// LoadPolicy reads a JSON policy file of the form {"role": ["permission", ...]}.
+func LoadPolicy(path string) (Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := Policy{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Allows returns true if any of the roles grants the permission.
+func (p Policy) Allows(roles []string, perm Permission) bool {
+	for _, role := range roles {
+		for _, granted := range p[role] {
+			if granted == perm || granted == PermAll {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Allowed returns true if the request is granted the permission by the roles of its user and, for the
+// requests authenticated by an API key, by the scopes of the key as well.
+func Allowed(c *gin.Context, policy Policy, perm Permission) bool {
+	if scopes, ok := c.Get(utils.CtxScopes); ok {
+		scoped := false
+		for _, scope := range scopes.([]string) {
+			if Permission(scope) == perm || Permission(scope) == PermAll {
+				scoped = true
+				break
+			}
+		}
+		if !scoped {
+			return false
+		}
+	}
+	return policy.Allows(c.GetStringSlice(utils.CtxRoles), perm)
+}
+
+// RequirePermission aborts the request with 403 unless the request is granted every permission.
+func RequirePermission(policy Policy, perms ...Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, perm := range perms {
+			if !Allowed(c, policy, perm) {
+				forbid(c)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+func forbid(c *gin.Context) {
+	resp := helpers.NewResponse()
+	c.AbortWithStatusJSON(http.StatusForbidden,
+		resp.Error(helpers.ErrCodeUnauthorized, "Forbidden", helpers.ErrUnAuthorized))
+}
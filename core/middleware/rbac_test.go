@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/crazi-coder/report-service/core/utils"
+	"github.com/gin-gonic/gin"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		roles  []string
+		scopes []string
+		perm   Permission
+		want   bool
+	}{
+		{"token granted by the role", []string{"viewer"}, nil, PermViewSessions, true},
+		{"token not granted by the role", []string{"viewer"}, nil, PermRunReports, false},
+		{"token of an admin", []string{utils.RoleAdmin}, nil, PermRevokeTokens, true},
+		{"key scope granted by the role", []string{"analyst"}, []string{string(PermViewSessions)}, PermViewSessions, true},
+		{"key scope outside of the scopes", []string{"analyst"}, []string{string(PermViewSessions)}, PermRunReports, false},
+		// The owner lost the permission since the key was created, the scope alone does not grant it.
+		{"key scope no longer granted by the role", []string{"viewer"}, []string{string(PermRunReports)},
+			PermRunReports, false},
+		{"key of every scope", []string{"viewer"}, []string{string(PermAll)}, PermViewSessions, true},
+		{"key of every scope beyond the role", []string{"viewer"}, []string{string(PermAll)}, PermRunReports, false},
+		{"key without scopes", []string{utils.RoleAdmin}, []string{}, PermViewSessions, false},
+		{"key of an owner without roles", nil, []string{string(PermViewSessions)}, PermViewSessions, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Set(utils.CtxRoles, tt.roles)
+			if tt.scopes != nil {
+				c.Set(utils.CtxScopes, tt.scopes)
+			}
+			if got := Allowed(c, DefaultPolicy, tt.perm); got != tt.want {
+				t.Errorf("Allowed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package revocation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/gomodule/redigo/redis"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// PurgeInterval is the interval the revocations of the expired tokens are deleted at.
+const PurgeInterval = time.Hour
+
+// notRevokedTTL is the lifetime of the cached "checked, not revoked" markers. The revocations overwrite them, it
+// only bounds how long a revocation written while Redis was unavailable is missed.
+const notRevokedTTL = 30 * time.Second
+
+// notRevoked is the cached value of the tokens and users checked in PostgreSQL and not revoked.
+const notRevoked = 0
+
+// Store records the revoked tokens. A token is revoked by its jti until it expires, or along with
+// every token of the user issued before the revocation.
+type Store interface {
+	Revoke(ctx context.Context, schema string, userID string, jti string, expiresAt time.Time) (bool, error)
+	RevokeUser(ctx context.Context, schema string, userID string) error
+	IsRevoked(ctx context.Context, schema string, userID string, jti string, issuedAt time.Time) (bool, error)
+	// Purge deletes the revocations of the expired tokens of the schemas, the tokens are rejected anyway.
+	Purge(ctx context.Context, schemas []string) error
+}
+
+// store keeps the revocations in the tenant schema, Redis is used as a cache in front of it when configured. Both
+// the revocations and the "not revoked" results are cached, the latter briefly and without overwriting a
+// revocation, so the requests of the tokens in use do not reach PostgreSQL. A token or user missing from Redis is
+// checked against PostgreSQL, a revocation may have been evicted from Redis, and the result is cached again.
+type store struct {
+	conn    *pgxpool.Pool
+	redis   *redis.Pool
+	logger  *logrus.Logger
+	dialect goqu.DialectWrapper
+	// ttl is the longest token lifetime, user revocations are not needed in Redis after it.
+	ttl time.Duration
+}
+
+// New creates a new revocation Store, the redis pool is optional.
+func New(conn *pgxpool.Pool, rds *redis.Pool, logger *logrus.Logger, ttl time.Duration) Store {
+	return &store{conn: conn, redis: rds, logger: logger, dialect: goqu.Dialect("postgres"), ttl: ttl}
+}
+
+// Revoke revokes a single token until it expires. It returns false when the token was already revoked, the
+// insert is the claim of the token so only one of concurrent rotations of a refresh token gets true.
+func (s *store) Revoke(ctx context.Context, schema string, userID string, jti string, expiresAt time.Time) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+	tbl := goqu.S(schema).Table("auth_revoked_token")
+	uid, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	iq := s.dialect.Insert(tbl).Rows(goqu.Record{
+		"jti": jti, "user_id": uid, "expires_at": expiresAt.UTC(),
+	}).OnConflict(goqu.DoNothing()).Prepared(true)
+	q, args, err := iq.ToSQL()
+	if err != nil {
+		return false, err
+	}
+	tag, err := s.conn.Exec(ctx, q, args...)
+	if err != nil {
+		return false, err
+	}
+	claimed := tag.RowsAffected() == 1
+	if ttl := time.Until(expiresAt); ttl > 0 {
+		// Overwrites the "not revoked" marker of the token.
+		s.cache(ctx, jtiKey(schema, jti), 1, ttl)
+	}
+	return claimed, nil
+}
+
+// Purge deletes the revocations of the expired tokens, a schema without the table is skipped.
+func (s *store) Purge(ctx context.Context, schemas []string) error {
+	for _, schema := range schemas {
+		dq := s.dialect.Delete(goqu.S(schema).Table("auth_revoked_token")).Where(
+			goqu.C("expires_at").Lt(time.Now().UTC()),
+		).Prepared(true)
+		q, args, err := dq.ToSQL()
+		if err != nil {
+			return err
+		}
+		tag, err := s.conn.Exec(ctx, q, args...)
+		if err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == pgUndefinedTable {
+				continue
+			}
+			return err
+		}
+		if n := tag.RowsAffected(); n > 0 {
+			s.logger.WithContext(ctx).WithFields(logrus.Fields{"schema": schema, "tokens": n}).Debug(
+				"Purged the expired token revocations")
+		}
+	}
+	return nil
+}
+
+// RevokeUser revokes every token of the user issued until now.
+func (s *store) RevokeUser(ctx context.Context, schema string, userID string) error {
+	uid, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	iq := s.dialect.Insert(goqu.S(schema).Table("auth_user_revocation")).Rows(goqu.Record{
+		"user_id": uid, "revoked_before": now,
+	}).OnConflict(goqu.DoUpdate("user_id", goqu.Record{"revoked_before": now})).Prepared(true)
+	q, args, err := iq.ToSQL()
+	if err != nil {
+		return err
+	}
+	if _, err := s.conn.Exec(ctx, q, args...); err != nil {
+		return err
+	}
+	if s.redis == nil {
+		return nil
+	}
+	// Overwrites the "not revoked" marker of the user.
+	return s.do(ctx, "SET", userKey(schema, userID), now.Unix(), "EX", int64(s.ttl.Seconds()))
+}
+
+// IsRevoked returns true if the token was revoked.
+func (s *store) IsRevoked(ctx context.Context, schema string, userID string, jti string, issuedAt time.Time) (bool, error) {
+	if s.redis != nil {
+		revoked, known, err := s.isRevokedRedis(ctx, schema, userID, jti, issuedAt)
+		if err == nil && known {
+			return revoked, nil
+		}
+		if err != nil {
+			s.logger.WithContext(ctx).WithError(err).Warn("Token revocation cache unavailable, checking postgres")
+		}
+	}
+	return s.isRevokedPostgres(ctx, schema, userID, jti, issuedAt)
+}
+
+// isRevokedRedis returns known false when the token or its user is missing from the cache, PostgreSQL has to
+// be checked then.
+func (s *store) isRevokedRedis(ctx context.Context, schema string, userID string, jti string,
+	issuedAt time.Time) (revoked bool, known bool, err error) {
+	conn, err := s.redis.GetContext(ctx)
+	if err != nil {
+		return false, false, err
+	}
+	defer conn.Close()
+	values, err := redis.Values(conn.Do("MGET", jtiKey(schema, jti), userKey(schema, userID)))
+	if err != nil {
+		return false, false, err
+	}
+	if jti != "" {
+		if values[0] == nil {
+			return false, false, nil
+		}
+		marker, err := redis.Int64(values[0], nil)
+		if err != nil {
+			return false, false, err
+		}
+		if marker != notRevoked {
+			return true, true, nil
+		}
+	}
+	if values[1] == nil {
+		return false, false, nil
+	}
+	before, err := redis.Int64(values[1], nil)
+	if err != nil {
+		return false, false, err
+	}
+	return before != notRevoked && !issuedAt.After(time.Unix(before, 0)), true, nil
+}
+
+func (s *store) isRevokedPostgres(ctx context.Context, schema string, userID string, jti string, issuedAt time.Time) (bool, error) {
+	uid, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return false, err
+	}
+	if jti != "" {
+		nq := s.dialect.From(goqu.S(schema).Table("auth_revoked_token")).Select("expires_at").Where(
+			goqu.Ex{"jti": jti},
+		).Prepared(true)
+		q, args, err := nq.ToSQL()
+		if err != nil {
+			return false, err
+		}
+		var expiresAt time.Time
+		err = s.conn.QueryRow(ctx, q, args...).Scan(&expiresAt)
+		switch err {
+		case nil:
+			if ttl := time.Until(expiresAt); ttl > 0 {
+				s.cache(ctx, jtiKey(schema, jti), 1, ttl)
+			}
+			return true, nil
+		case pgx.ErrNoRows:
+			s.markNotRevoked(ctx, jtiKey(schema, jti))
+		default:
+			return false, err
+		}
+	}
+	nq := s.dialect.From(goqu.S(schema).Table("auth_user_revocation")).Select("revoked_before").Where(
+		goqu.Ex{"user_id": uid},
+	).Prepared(true)
+	q, args, err := nq.ToSQL()
+	if err != nil {
+		return false, err
+	}
+	var before time.Time
+	err = s.conn.QueryRow(ctx, q, args...).Scan(&before)
+	switch err {
+	case nil:
+		s.cache(ctx, userKey(schema, userID), before.Unix(), s.ttl)
+		return !issuedAt.After(before), nil
+	case pgx.ErrNoRows:
+		s.markNotRevoked(ctx, userKey(schema, userID))
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// cache writes back a revocation read from PostgreSQL, the token is rejected anyway when it fails.
+func (s *store) cache(ctx context.Context, key string, value interface{}, ttl time.Duration) {
+	if s.redis == nil {
+		return
+	}
+	if err := s.do(ctx, "SET", key, value, "EX", int64(ttl.Seconds())+1); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Warn("Unable to cache the token revocation")
+	}
+}
+
+// markNotRevoked caches a "not revoked" result read from PostgreSQL. It does not overwrite the key, a revocation
+// cached since the read wins.
+func (s *store) markNotRevoked(ctx context.Context, key string) {
+	if s.redis == nil {
+		return
+	}
+	if err := s.do(ctx, "SET", key, notRevoked, "EX", int64(notRevokedTTL.Seconds()), "NX"); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Warn("Unable to cache the token revocation")
+	}
+}
+
+func (s *store) do(ctx context.Context, cmd string, args ...interface{}) error {
+	conn, err := s.redis.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do(cmd, args...)
+	return err
+}
+
+// pgUndefinedTable is the PostgreSQL error code returned for the schemas without the revocation tables.
+const pgUndefinedTable = "42P01"
+
+func jtiKey(schema string, jti string) string {
+	return fmt.Sprintf("revoked:jti:%s:%s", schema, jti)
+}
+
+func userKey(schema string, userID string) string {
+	return fmt.Sprintf("revoked:user:%s:%s", schema, userID)
+}
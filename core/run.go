@@ -5,37 +5,57 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
+	"sync"
 	"time"
 
 	"github.com/crazi-coder/report-service/controller"
+	"github.com/crazi-coder/report-service/core/config"
+	"github.com/crazi-coder/report-service/core/events"
+	"github.com/crazi-coder/report-service/core/health"
+	"github.com/crazi-coder/report-service/core/ldflags"
+	"github.com/crazi-coder/report-service/core/logging"
+	"github.com/crazi-coder/report-service/core/metrics"
 	"github.com/crazi-coder/report-service/core/middleware"
+	"github.com/crazi-coder/report-service/core/revocation"
+	"github.com/crazi-coder/report-service/core/scheduler"
+	"github.com/crazi-coder/report-service/core/storage"
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/crazi-coder/report-service/core/tracing"
 	"github.com/crazi-coder/report-service/core/utils/helpers"
 	"github.com/crazi-coder/report-service/core/utils/libs"
+	"github.com/crazi-coder/report-service/core/worker"
 	"github.com/crazi-coder/report-service/views"
 	"github.com/gin-gonic/gin"
+	"github.com/gocelery/gocelery"
+	"github.com/gomodule/redigo/redis"
 	"github.com/sirupsen/logrus"
 )
 
+// httpShutdownShare is the share of the grace period the requests get to finish on shutdown, the running
+// report jobs get the rest of it, at least 1 - httpShutdownShare of the grace period.
+const httpShutdownShare = 0.5
+
 // Server is the serve Config Object
 type Server interface {
 	Start(context.Context) error
 }
 
 type server struct {
-	host   string
-	port   string
+	conf   *config.Config
 	route  *gin.Engine
 	logger *logrus.Logger
 }
 
-// NewServer creates a new BiddanoAPIServer instance
-func NewServer(ctx context.Context, host string, port string) Server {
-	// if ldflags.Environment == "production" {
-	// 	gin.SetMode(gin.ReleaseMode)
-	// }
-	s := server{host: host, port: port, route: gin.Default()}
+// NewServer creates a new BiddanoAPIServer instance, the configuration has to be validated by ValidateServer.
+func NewServer(ctx context.Context, conf *config.Config) Server {
+	if ldflags.Environment == "production" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	s := server{conf: conf, route: gin.New()}
 	logger := logrus.StandardLogger()
+	// The request id comes first so the recovery and access logs of the request carry it.
+	s.route.Use(middleware.RequestID(), middleware.Tracing(conf.Tracing.ServiceName),
+		middleware.LoggerWithConfig(logger), middleware.Metrics())
 	// // To initialize Sentry's handler, you need to initialize Sentry itself beforehand
 	// if ldflags.Environment == "production" {
 
@@ -51,8 +71,6 @@ func NewServer(ctx context.Context, host string, port string) Server {
 	// 		fmt.Printf("Sentry initialization failed: %v\n", err)
 	// 	}
 
-	logger.SetLevel(logrus.DebugLevel)
-
 	// 	//Recovery middleware recovers from any panics and writes a 500 if there was one.
 	// 	s.route.Use(gin.CustomRecovery(func(c *gin.Context, recovered interface{}) {
 	// 		e := helpers.NewResponse()
@@ -74,53 +92,346 @@ func NewServer(ctx context.Context, host string, port string) Server {
 				e.Error(http.StatusInternalServerError, "Server error", nil))
 		}
 	}))
-	logger.SetLevel(logrus.DebugLevel)
-	logger.SetFormatter(&logrus.TextFormatter{})
 	// }
+	// The level was checked by ValidateServer.
+	level, _ := logrus.ParseLevel(conf.Log.Level)
+	logging.Configure(logger, level)
 
 	s.logger = logger
 	s.route.Use(middleware.CORSMiddleware())
 	return &s
 }
 
+// Start serves the requests until the context is done, it then drains the requests and the report jobs
+// for the grace period before returning, see httpShutdownShare.
 func (s server) Start(ctx context.Context) error {
 	// Postgres Information
 
-	addrs := fmt.Sprintf("%s:%s", s.host, s.port)
+	conf := s.conf
+	addrs := fmt.Sprintf("%s:%s", conf.Server.Host, conf.Server.Port)
+	grace := conf.ShutdownGracePeriod
+	// The background loops stop with ctx, the report jobs get the grace period to finish.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	var background sync.WaitGroup
+	goBackground := func(fn func(context.Context)) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			fn(ctx)
+		}()
+	}
+	// goEvery runs fn now and then at every interval until ctx is done, the failures are logged.
+	goEvery := func(interval time.Duration, failure string, fn func(context.Context) error) {
+		goBackground(func(ctx context.Context) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				if err := fn(ctx); err != nil && ctx.Err() == nil {
+					s.logger.WithError(err).Error(failure)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		})
+	}
 
-	psqlPort, _ := strconv.Atoi(helpers.GetEnv("POSTGRES_PORT", "5432"))
-	psqlConf := libs.PgConfig{
-		Host:     helpers.GetEnv("PROD_INFIVIZ_DB_SERVER_IP", "35.185.187.195"),
-		Port:     psqlPort,
-		Database: helpers.GetEnv("PROD_INFIVIZ_DB_NAME", "infiviz_db_01"),
-		User:     helpers.GetEnv("PROD_INFIVIZ_DB_USERNAME", "backend_read_user"),
-		Password: helpers.GetEnv("PROD_INFIVIZ_DB_PASSWORD", "S6mGtxpNF5eM+OWzZGoej5k+Blot0gdgbY/YPXTG"),
+	shutdownTracing, err := tracing.Setup(ctx, tracingConfig(conf.Tracing))
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to set up tracing")
+		return err
 	}
-	psql, err := libs.NewPostgreSQLConnection(ctx, s.logger, 1, 10, &psqlConf)
+	defer shutdownTracing(context.Background()) // Flush the spans of the last requests.
+
+	psql, err := libs.NewPostgreSQLConnection(ctx, s.logger, 1, 10, pgConfig(conf.Postgres))
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to create postgres connection")
 		return err
 	}
 	defer psql.Close() // Close connection before stopping the server.
+	// The metrics are served apart from the API, it is public and they are not.
+	if conf.Server.MetricsAddr != "" {
+		stopMetrics, err := serveMetrics(s.logger, conf.Server.MetricsAddr)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to start the metrics listener")
+			return err
+		}
+		defer stopMetrics()
+	}
+	if err := metrics.RegisterPool(psql); err != nil {
+		s.logger.WithError(err).Error("Failed to register the pool metrics")
+		return err
+	}
+	// The probes are registered before the authenticated groups, they are not authenticated.
+	checker := health.New(conf.Server.HealthCheckTimeout)
+	checker.Add("postgres", psql.Ping)
+	hv := views.NewHealthView(checker, &s.route.RouterGroup, s.logger)
+	hv.Register(ctx)
 
-	// After the connection has been established, enable the jwtAuthMiddleware
-	s.route.Use(middleware.AuthMiddleware(psql, s.logger))
+	// Redis is optional, it is only connected when redis.host is configured.
+	var rds *redis.Pool
+	if rdsConf := redisConfig(conf.Redis); rdsConf != nil {
+		rds, err = libs.NewRedisPool(ctx, s.logger, conf.Redis.MaxIdle, conf.Redis.MaxActive, rdsConf)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to create redis connection")
+			return err
+		}
+		defer rds.Close()
+		checker.Add("redis", func(ctx context.Context) error { return libs.PingRedis(ctx, rds) })
+	}
+
+	store, err := newBlobStore(ctx, conf.Storage)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to create report storage")
+		return err
+	}
+
+	policy := middleware.DefaultPolicy
+	if path := conf.Auth.PolicyFile; path != "" {
+		if policy, err = middleware.LoadPolicy(path); err != nil {
+			s.logger.WithError(err).Error("Failed to load the RBAC policy")
+			return err
+		}
+	}
+
+	verifier, err := middleware.NewVerifier(ctx, s.logger, jwtConfig(conf.JWT))
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to load the JWT keys")
+		return err
+	}
+	goBackground(verifier.Start)
+
+	// Tokens are only issued when a signing key is configured, otherwise the auth service issues them.
+	signer, err := middleware.NewSigner(signerConfig(conf.JWT))
+	switch {
+	case err == nil:
+	case errors.Is(err, middleware.ErrNoSigningKey):
+		s.logger.Info("No JWT signing key configured, the token endpoint is disabled")
+	default:
+		s.logger.WithError(err).Error("Failed to load the JWT signing key")
+		return err
+	}
+	// New and upgraded passwords are encoded with the preferred hasher, the others are still verified.
+	if err := helpers.SetPreferredHasher(conf.Auth.PasswordHasher); err != nil {
+		s.logger.WithError(err).Error("Invalid auth.password_hasher")
+		return err
+	}
+	revoked := revocation.New(psql, rds, s.logger, conf.JWT.RevocationTTL)
+	// Only the schemas of the known tenants reach the SQL queries.
+	tenants := tenant.New(psql, s.logger, conf.Tenants.Table, conf.Tenants.Refresh)
+	if err := tenants.Load(ctx); err != nil {
+		s.logger.WithError(err).Error("Failed to load the tenants")
+		return err
+	}
+	goBackground(tenants.Start)
+	goEvery(revocation.PurgeInterval, "Unable to purge the expired token revocations", func(ctx context.Context) error {
+		return revoked.Purge(ctx, tenants.Schemas())
+	})
+
+	apiKeyCtl := controller.NewAPIKeyController(ctx, s.logger, psql, tenants)
+	auth := middleware.AuthMiddleware(psql, s.logger, verifier, revoked, apiKeyCtl, tenants)
+
+	authGroup := s.route.Group("/api/v1/auth")
+	tokenCtl := controller.NewAuthController(ctx, s.logger, psql, signer, verifier, revoked, tenants)
+	av := views.NewAuthView(tokenCtl, authGroup, s.logger, auth, policy)
+	av.Register(ctx)
+	kv := views.NewAPIKeyView(apiKeyCtl, authGroup, s.logger, auth, policy)
+	kv.Register(ctx)
+
+	// Reports are either generated in process or published to the celery workers.
+	var (
+		queue        worker.Queue
+		pool         *worker.Pool
+		client       *gocelery.CeleryClient
+		celeryBroker gocelery.CeleryBroker
+	)
+	if conf.Queue.Backend == config.QueueCelery {
+		client, celeryBroker, err = newCeleryClient(s.logger, conf.Celery, 1, rds)
+		if err != nil {
+			s.logger.WithError(err).Error("Failed to create celery client")
+			return err
+		}
+		queue = worker.NewCeleryQueue(celeryBroker)
+		if rds != nil && conf.Celery.Broker == config.BrokerRedis {
+			err = metrics.RegisterQueueDepth(celeryDepth(rds, conf.Celery.Queue))
+			// The reports are generated by the celery workers, they refresh a heartbeat in redis.
+			checker.Add("worker", func(ctx context.Context) error {
+				return worker.CheckHeartbeat(ctx, rds, heartbeatKey(conf.Celery))
+			})
+		}
+	} else {
+		pool = worker.NewPool(s.logger, conf.Queue.Workers, conf.Queue.Buffer)
+		queue = pool
+		err = metrics.RegisterQueueDepth(func() float64 { return float64(pool.Depth()) })
+		checker.Add("worker", pool.Check)
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to register the queue metrics")
+		return err
+	}
+
+	// Report events are shared through postgres, the workers only publish them.
+	broker := events.NewBroker(psql, s.logger)
+	goBackground(broker.Listen)
 
-	v1 := s.route.Group("/api/v1/report")
-	authCtl := controller.NewReportController(ctx, s.logger, psql)
-	v := views.NewReportView(authCtl, v1, s.logger)
+	// After the connection has been established, enable the jwtAuthMiddleware
+	v1 := s.route.Group("/api/v1/report", auth, middleware.Localize())
+	authCtl := controller.NewReportController(ctx, s.logger, psql, queue, store, broker)
+	inProcess := client != nil && conf.Celery.Broker == config.BrokerMemory
+	if pool != nil {
+		pool.Start(jobCtx, authCtl.Execute)
+	}
+	if inProcess {
+		// Nobody else can consume the in-memory broker, so run the celery worker in process.
+		worker.RegisterTasks(jobCtx, client, s.logger, authCtl.Execute)
+		client.StartWorker()
+	}
+	if pool != nil || inProcess {
+		// The reports left queued by the last shutdown are generated again, the in process queues lost them.
+		goBackground(func(ctx context.Context) {
+			if err := authCtl.Requeue(ctx, tenants.Schemas()); err != nil && ctx.Err() == nil {
+				s.logger.WithError(err).Error("Unable to enqueue the queued reports")
+			}
+		})
+	}
+	// The reports left running by a crashed or killed worker are queued again once their heartbeat is stale.
+	goEvery(controller.RecoverInterval, "Unable to recover the abandoned reports", func(ctx context.Context) error {
+		return authCtl.Recover(ctx, tenants.Schemas())
+	})
+	v := views.NewReportView(authCtl, v1, s.logger, policy, conf.Server.WriteTimeout)
 	v.Register(ctx)
 
+	scheduleCtl := controller.NewScheduleController(ctx, s.logger, psql, authCtl, tenants)
+	sv := views.NewScheduleView(scheduleCtl, v1, s.logger, policy)
+	sv.Register(ctx)
+	if conf.Scheduler.Enabled {
+		// Every replica runs the scheduler, only the elected leader fires the schedules.
+		goBackground(scheduler.New(psql, s.logger, time.Minute, scheduleCtl.RunDue).Start)
+	}
+
 	srv := &http.Server{
 		Addr:           addrs,
 		Handler:        s.route,
-		ReadTimeout:    5 * time.Second,
-		WriteTimeout:   5 * time.Second,
+		ReadTimeout:    conf.Server.ReadTimeout,
+		WriteTimeout:   conf.Server.WriteTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
-	err = srv.ListenAndServe()
-	if err != nil {
-		s.logger.Error(err)
+	// The event streams only end with their report, they are closed so Shutdown does not wait for them.
+	srv.RegisterOnShutdown(broker.Close)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	s.logger.WithField("addr", addrs).Info("Server started")
+	select {
+	case err = <-serveErr:
+		s.logger.WithError(err).Error("Server failed")
+	case <-ctx.Done():
+		s.logger.WithField("grace_period", grace.String()).Info("Shutting down the server")
+	}
+
+	// The requests are drained first, they may still queue reports. A slow request does not use up the time of
+	// the report jobs, they are only queued again when the grace period is over.
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), grace)
+	defer cancelShutdown()
+	httpCtx, cancelHTTP := context.WithTimeout(shutdownCtx, time.Duration(float64(grace)*httpShutdownShare))
+	defer cancelHTTP()
+	if e := srv.Shutdown(httpCtx); e != nil {
+		// The streams still open after their share of the grace period, e.g. the report watchers, are cut.
+		s.logger.WithError(e).Warn("Requests still running after their share of the grace period, closing them")
+		srv.Close()
+	}
+	cancel()
+	background.Wait()
+	if pool != nil {
+		if e := pool.Shutdown(shutdownCtx); e != nil {
+			s.logger.WithError(e).Warn("Reports still running after the grace period, they are queued again")
+		}
+	}
+	if inProcess {
+		stopCeleryWorker(shutdownCtx, client, cancelJobs)
+	}
+	s.logger.Info("Server stopped")
+	return err
+}
+
+// pgConfig returns the PostgreSQL connection of the configuration.
+func pgConfig(conf config.Postgres) *libs.PgConfig {
+	return &libs.PgConfig{
+		Host:     conf.Host,
+		Port:     conf.Port,
+		Database: conf.Database,
+		User:     conf.User,
+		Password: conf.Password,
+	}
+}
+
+// jwtConfig returns the JWT verification configuration.
+func jwtConfig(conf config.JWT) middleware.VerifierConfig {
+	return middleware.VerifierConfig{
+		Secret:        []byte(conf.Secret),
+		PublicKeyFile: conf.PublicKeyFile,
+		JWKSURL:       conf.JWKSURL,
+		Refresh:       conf.KeysRefresh,
+		Issuer:        conf.Issuer,
+		Audience:      conf.Audience,
+		Leeway:        conf.Leeway,
+	}
+}
+
+// signerConfig returns the configuration of the tokens issued by the service.
+func signerConfig(conf config.JWT) middleware.SignerConfig {
+	return middleware.SignerConfig{
+		Secret:         []byte(conf.Secret),
+		PrivateKeyFile: conf.PrivateKeyFile,
+		KeyID:          conf.KeyID,
+		Issuer:         conf.Issuer,
+		Audience:       conf.Audience,
+		AccessTTL:      conf.AccessTTL,
+		RefreshTTL:     conf.RefreshTTL,
+	}
+}
+
+// tracingConfig returns the tracing configuration.
+func tracingConfig(conf config.Tracing) tracing.Config {
+	return tracing.Config{
+		Exporter:    conf.Exporter,
+		ServiceName: conf.ServiceName,
+		SampleRatio: conf.SampleRatio,
+	}
+}
+
+// redisConfig returns the Redis connection of the configuration, nil if Redis is not configured.
+func redisConfig(conf config.Redis) *libs.RedisConfig {
+	if conf.Host == "" {
+		return nil
+	}
+	return &libs.RedisConfig{
+		Host:          conf.Host,
+		Port:          conf.Port,
+		Password:      conf.Password,
+		Database:      conf.Database,
+		UseTLS:        conf.TLS,
+		TLSSkipVerify: conf.TLSSkipVerify,
+	}
+}
+
+// newBlobStore creates the report artifact storage of the configuration.
+func newBlobStore(ctx context.Context, conf config.Storage) (storage.BlobStore, error) {
+	if conf.Backend == config.StorageS3 {
+		return storage.NewS3Store(ctx, &storage.S3Config{
+			Endpoint:  conf.S3.Endpoint,
+			Region:    conf.S3.Region,
+			Bucket:    conf.S3.Bucket,
+			AccessKey: conf.S3.AccessKey,
+			SecretKey: conf.S3.SecretKey,
+			UseSSL:    conf.S3.UseSSL,
+		})
 	}
-	return nil
+	return storage.NewLocalStore(conf.LocalDir)
 }
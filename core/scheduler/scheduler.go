@@ -0,0 +1,90 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// LockKey is the PostgreSQL advisory lock held by the leading scheduler.
+const LockKey int64 = 0x7265706f7274 // "report"
+
+// RunFunc fires the schedules which are due at the given time.
+type RunFunc func(ctx context.Context, now time.Time) error
+
+// Scheduler calls the RunFunc on every tick while it is the leader. The leader is the replica holding
+// the advisory lock, the lock is released by PostgreSQL as soon as its connection is lost.
+type Scheduler struct {
+	pool     *pgxpool.Pool
+	logger   *logrus.Logger
+	interval time.Duration
+	run      RunFunc
+	conn     *pgx.Conn
+	leader   bool
+}
+
+// New creates a new Scheduler ticking at the given interval.
+func New(pool *pgxpool.Pool, logger *logrus.Logger, interval time.Duration, run RunFunc) *Scheduler {
+	return &Scheduler{pool: pool, logger: logger, interval: interval, run: run}
+}
+
+// Start runs the scheduler until the context is done.
+func (s *Scheduler) Start(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	defer s.release()
+	for {
+		if s.elect(ctx) {
+			if err := s.run(ctx, time.Now()); err != nil {
+				s.logger.WithError(err).Error("Scheduler run failed")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// elect returns true if this replica holds the leader lock, trying to acquire it when it does not.
+func (s *Scheduler) elect(ctx context.Context) bool {
+	if s.conn == nil {
+		// The lock is bound to the session, so it is not taken from the pool.
+		conn, err := pgx.ConnectConfig(ctx, s.pool.Config().ConnConfig)
+		if err != nil {
+			s.logger.WithError(err).Error("Scheduler unable to connect")
+			return false
+		}
+		s.conn = conn
+	}
+	if s.leader {
+		// A lost connection also lost the lock, another replica may have taken over.
+		if err := s.conn.Ping(ctx); err != nil {
+			s.logger.WithError(err).Warn("Scheduler lost the leader connection")
+			s.release()
+		}
+		return s.leader
+	}
+	if err := s.conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", LockKey).Scan(&s.leader); err != nil {
+		s.logger.WithError(err).Error("Scheduler unable to acquire the leader lock")
+		s.release()
+		return false
+	}
+	if s.leader {
+		s.logger.Info("Scheduler elected as leader")
+	}
+	return s.leader
+}
+
+// release closes the leader connection, which releases the lock.
+func (s *Scheduler) release() {
+	if s.conn != nil {
+		s.conn.Close(context.Background())
+	}
+	s.conn = nil
+	s.leader = false
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalStore(t *testing.T) {
+	store, err := NewLocalStore(filepath.Join(t.TempDir(), "reports"))
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	testBlobStore(t, store, "tenant_a/")
+}
+
+func TestLocalStoreNoPartialObject(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewLocalStore(root)
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	failing := errors.New("read failed")
+	err = store.Put(context.Background(), "report.xlsx", errReader{failing}, -1, "text/plain")
+	if !errors.Is(err, failing) {
+		t.Fatalf("Put error = %v, want %v", err, failing)
+	}
+	if _, err := store.Get(context.Background(), "report.xlsx"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after a failed Put error = %v, want ErrNotFound", err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestLocalStoreKeyEscape(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"../report.xlsx", "tenant_a/../../report.xlsx", ""} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("Put(%q) succeeded, want an invalid key error", key)
+		}
+		if _, err := store.Get(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) error = %v, want an invalid key error", key, err)
+		}
+		if err := store.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded, want an invalid key error", key)
+		}
+	}
+}
+
+func TestLocalStoreSignedURL(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStore: %v", err)
+	}
+	_, err = store.SignedURL(context.Background(), "report.xlsx", time.Minute, "report.xlsx")
+	if !errors.Is(err, ErrSignedURLNotSupported) {
+		t.Errorf("SignedURL error = %v, want ErrSignedURLNotSupported", err)
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
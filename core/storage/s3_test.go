@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The S3 tests run against the bucket of TEST_S3_ENDPOINT, e.g. a local MinIO, they are skipped without it.
+func testS3Store(t *testing.T) BlobStore {
+	t.Helper()
+	endpoint := os.Getenv("TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TEST_S3_ENDPOINT is not set")
+	}
+	useSSL, _ := strconv.ParseBool(os.Getenv("TEST_S3_USE_SSL"))
+	bucket := os.Getenv("TEST_S3_BUCKET")
+	if bucket == "" {
+		bucket = "reports"
+	}
+	store, err := NewS3Store(context.Background(), &S3Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("TEST_S3_REGION"),
+		Bucket:    bucket,
+		AccessKey: os.Getenv("TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("TEST_S3_SECRET_KEY"),
+		UseSSL:    useSSL,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store: %v", err)
+	}
+	return store
+}
+
+func TestS3Store(t *testing.T) {
+	testBlobStore(t, testS3Store(t), "test/")
+}
+
+func TestS3StoreSignedURL(t *testing.T) {
+	store := testS3Store(t)
+	ctx := context.Background()
+	key := fmt.Sprintf("test/report-%d-1.xlsx", time.Now().UnixNano())
+	content := []byte("report content")
+	if err := store.Put(ctx, key, bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	defer store.Delete(ctx, key)
+
+	signed, err := store.SignedURL(ctx, key, time.Minute, "photo sessions.xlsx")
+	if err != nil {
+		t.Fatalf("SignedURL: %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("invalid signed URL %q: %v", signed, err)
+	}
+	if got, want := u.Query().Get("response-content-disposition"), `attachment; filename="photo sessions.xlsx"`; got != want {
+		t.Errorf("content disposition = %q, want %q", got, want)
+	}
+	resp, err := http.Get(signed)
+	if err != nil {
+		t.Fatalf("downloading the signed URL: %v", err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the signed URL: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(got, content) {
+		t.Errorf("signed URL = %d %q, want 200 %q", resp.StatusCode, got, content)
+	}
+}
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when the requested object does not exist.
+var ErrNotFound = errors.New("object does not exist")
+
+// ErrSignedURLNotSupported is returned by backends which can not hand out signed URLs,
+// the caller is expected to stream the object instead.
+var ErrSignedURLNotSupported = errors.New("signed URLs are not supported by the storage backend")
+
+// BlobStore stores the generated report artifacts.
+type BlobStore interface {
+	// Put stores the content of r under key, size is -1 when unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the object stored under key, the caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object, deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a time limited URL downloading the object as filename.
+	SignedURL(ctx context.Context, key string, expiry time.Duration, filename string) (string, error)
+}
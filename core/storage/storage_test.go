@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// testBlobStore runs the BlobStore contract against the store, the objects are written below prefix.
+func testBlobStore(t *testing.T, store BlobStore, prefix string) {
+	t.Helper()
+	ctx := context.Background()
+	key := fmt.Sprintf("%sreport-%d-1.xlsx", prefix, time.Now().UnixNano())
+	content := []byte("report content")
+
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing object error = %v, want ErrNotFound", err)
+	}
+	if err := store.Put(ctx, key, bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	// Deleting is not deferred, a failing test leaves the object behind to inspect it.
+	assertObject(t, store, key, content)
+
+	// Put replaces the object, the size may be unknown.
+	replaced := []byte("replaced content")
+	if err := store.Put(ctx, key, bytes.NewReader(replaced), -1, "text/plain"); err != nil {
+		t.Fatalf("Put of an unknown size: %v", err)
+	}
+	assertObject(t, store, key, replaced)
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a deleted object error = %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+}
+
+func assertObject(t *testing.T, store BlobStore, key string, want []byte) {
+	t.Helper()
+	r, err := store.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading the object: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("object = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // The container images do not ship the zoneinfo database.
+
+	"golang.org/x/text/language"
+)
+
+// localeLayouts are the default date layouts of the locales, by region and then by base language.
+var localeLayouts = map[string]string{
+	"US": "01/02/2006 03:04 PM",
+	"CA": "2006-01-02 15:04",
+	"en": "02/01/2006 15:04",
+	"fr": "02/01/2006 15:04",
+	"es": "02/01/2006 15:04",
+	"it": "02/01/2006 15:04",
+	"pt": "02/01/2006 15:04",
+	"de": "02.01.2006 15:04",
+	"pl": "02.01.2006 15:04",
+	"ru": "02.01.2006 15:04",
+	"tr": "02.01.2006 15:04",
+	"nl": "02-01-2006 15:04",
+	"sv": "2006-01-02 15:04",
+	"ja": "2006/01/02 15:04",
+	"zh": "2006/01/02 15:04",
+	"ko": "2006.01.02 15:04",
+}
+
+// localLayouts are the layouts without a UTC offset accepted by ParseTime, they are read in the timezone.
+var localLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// Settings are the regional settings of a tenant, they can be overridden for a request.
+type Settings struct {
+	Timezone string `json:"timezone"`
+	// Locale is a BCP 47 tag, it selects the date layout when DateFormat is empty.
+	Locale string `json:"locale"`
+	// DateFormat is a Go time layout, e.g. "02/01/2006 15:04".
+	DateFormat string       `json:"date_format"`
+	WeekStart  time.Weekday `json:"week_start"`
+	location   *time.Location
+}
+
+// DefaultSettings are used for the tenants without settings: UTC, the default layout of each date, see FormatOr,
+// and weeks starting on Monday.
+var DefaultSettings = Settings{Timezone: "UTC", WeekStart: time.Monday, location: time.UTC}
+
+// settingsKey holds the Settings of a request context.
+type settingsKey struct{}
+
+// WithSettings returns a context formatting and parsing the dates with the settings.
+func WithSettings(ctx context.Context, s Settings) context.Context {
+	return context.WithValue(ctx, settingsKey{}, s)
+}
+
+// SettingsFrom returns the settings of the context, DefaultSettings when none are set.
+func SettingsFrom(ctx context.Context) Settings {
+	if s, ok := ctx.Value(settingsKey{}).(Settings); ok {
+		return s
+	}
+	return DefaultSettings
+}
+
+// NewSettings validates the settings, the empty timezone is UTC.
+func NewSettings(timezone, locale, dateFormat string, weekStart time.Weekday) (Settings, error) {
+	s := Settings{Timezone: timezone, Locale: locale, DateFormat: dateFormat, WeekStart: weekStart}
+	if s.Timezone == "" {
+		s.Timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return Settings{}, fmt.Errorf("invalid timezone %q: %w", s.Timezone, err)
+	}
+	s.location = loc
+	if s.Locale != "" {
+		tag, err := language.Parse(s.Locale)
+		if err != nil {
+			return Settings{}, fmt.Errorf("invalid locale %q: %w", s.Locale, err)
+		}
+		s.Locale = tag.String()
+	}
+	// A layout without any reference value formats every time the same.
+	if s.DateFormat != "" && time.Unix(0, 0).Format(s.DateFormat) == s.DateFormat {
+		return Settings{}, fmt.Errorf("invalid date format %q", s.DateFormat)
+	}
+	if s.WeekStart < time.Sunday || s.WeekStart > time.Saturday {
+		return Settings{}, fmt.Errorf("invalid week start %d", s.WeekStart)
+	}
+	return s, nil
+}
+
+// Override returns the settings with the non empty values replaced.
+func (s Settings) Override(timezone, locale, dateFormat, weekStart string) (Settings, error) {
+	if timezone != "" {
+		s.Timezone = timezone
+	}
+	if locale != "" {
+		// The layout of the new locale applies unless a format is given too.
+		s.Locale, s.DateFormat = locale, ""
+	}
+	if dateFormat != "" {
+		s.DateFormat = dateFormat
+	}
+	if weekStart != "" {
+		ws, err := ParseWeekday(weekStart)
+		if err != nil {
+			return Settings{}, err
+		}
+		s.WeekStart = ws
+	}
+	return NewSettings(s.Timezone, s.Locale, s.DateFormat, s.WeekStart)
+}
+
+// Location returns the timezone of the settings.
+func (s Settings) Location() *time.Location {
+	if s.location == nil {
+		return time.UTC
+	}
+	return s.location
+}
+
+// Layout returns the date layout, the one of the locale when no format is set and RFC3339 without both.
+func (s Settings) Layout() string {
+	return s.layout(time.RFC3339)
+}
+
+// layout returns the date layout, the one of the locale when no format is set and def without both.
+func (s Settings) layout(def string) string {
+	if s.DateFormat != "" {
+		return s.DateFormat
+	}
+	if s.Locale != "" {
+		tag := language.Make(s.Locale)
+		if region, conf := tag.Region(); conf == language.Exact {
+			if layout, ok := localeLayouts[region.String()]; ok {
+				return layout
+			}
+		}
+		base, _ := tag.Base()
+		if layout, ok := localeLayouts[base.String()]; ok {
+			return layout
+		}
+	}
+	return def
+}
+
+// Format formats the time in the timezone and layout of the settings.
+func (s Settings) Format(t time.Time) string {
+	return t.In(s.Location()).Format(s.Layout())
+}
+
+// FormatOr formats the time in the timezone and layout of the settings, def is the layout used when the tenant
+// sets neither a date format nor a locale. It keeps the dates of the tenants without settings unchanged.
+func (s Settings) FormatOr(t time.Time, def string) string {
+	return t.In(s.Location()).Format(s.layout(def))
+}
+
+// ParseTime reads a RFC3339 time, or a date or time without offset in the timezone of the settings, including
+// the layout of the settings. A date alone is the start of the day, or the end of the day with endOfDay.
+func (s Settings) ParseTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, s.Location()); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Microsecond)
+		}
+		return t.UTC(), nil
+	}
+	layouts := localLayouts
+	if layout := s.Layout(); layout != time.RFC3339 {
+		layouts = append([]string{layout}, layouts...)
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, value, s.Location()); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// ParseWeekday reads a weekday by name, e.g. "monday", or by number, 0 being Sunday.
+func ParseWeekday(value string) (time.Weekday, error) {
+	if n, err := strconv.Atoi(value); err == nil && n >= 0 && n <= 6 {
+		return time.Weekday(n), nil
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), value) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid week start %q", value)
+}
@@ -0,0 +1,43 @@
+package tenant
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSettingsFormatOr(t *testing.T) {
+	at := time.Date(2023, time.March, 5, 14, 30, 0, 0, time.UTC)
+	paris, err := NewSettings("Europe/Paris", "", "", time.Monday)
+	if err != nil {
+		t.Fatalf("NewSettings: %v", err)
+	}
+	french, err := NewSettings("Europe/Paris", "fr-FR", "", time.Monday)
+	if err != nil {
+		t.Fatalf("NewSettings: %v", err)
+	}
+	custom, err := NewSettings("UTC", "fr-FR", "2006-01-02", time.Monday)
+	if err != nil {
+		t.Fatalf("NewSettings: %v", err)
+	}
+	tests := []struct {
+		name     string
+		settings Settings
+		want     string
+		wantOr   string
+	}{
+		{"tenant without settings", DefaultSettings, "2023-03-05T14:30:00Z", "05 Mar 23 14:30 UTC"},
+		{"timezone only", paris, "2023-03-05T15:30:00+01:00", "05 Mar 23 15:30 CET"},
+		{"locale", french, "05/03/2023 15:30", "05/03/2023 15:30"},
+		{"date format", custom, "2023-03-05", "2023-03-05"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.settings.Format(at); got != tt.want {
+				t.Errorf("Format = %q, want %q", got, tt.want)
+			}
+			if got := tt.settings.FormatOr(at, time.RFC822); got != tt.wantOr {
+				t.Errorf("FormatOr = %q, want %q", got, tt.wantOr)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crazi-coder/report-service/core/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// minReload limits the reloads triggered by lookups of an unknown schema.
+const minReload = time.Minute
+
+// Tenant is a customer of the service, its data lives in its own PostgreSQL schema.
+type Tenant struct {
+	Schema   string   `json:"schema"`
+	Name     string   `json:"name"`
+	Settings Settings `json:"settings"`
+}
+
+// Registry holds the known tenants, the schema names reaching the SQL queries are looked up in it
+// since they are used as identifiers and can not be passed as query parameters.
+type Registry struct {
+	conn    *pgxpool.Pool
+	logger  *logrus.Logger
+	table   string
+	refresh time.Duration
+	mu      sync.RWMutex
+	tenants map[string]*Tenant
+	loaded  time.Time
+	loading sync.Mutex
+	// tried is the last reload triggered by a lookup, it is guarded by loading.
+	tried time.Time
+}
+
+// New creates a new Registry. The tenants are read from the schema_name and name columns of the table
+// when given, e.g. "public.tenants", or else from the schemas having an auth_user table.
+func New(conn *pgxpool.Pool, logger *logrus.Logger, table string, refresh time.Duration) *Registry {
+	return &Registry{conn: conn, logger: logger, table: table, refresh: refresh, tenants: map[string]*Tenant{}}
+}
+
+// Start reloads the tenants until the context is done, the current tenants are kept when it fails.
+func (r *Registry) Start(ctx context.Context) {
+	if r.refresh <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Load(ctx); err != nil {
+				r.logger.WithError(err).Error("Unable to reload the tenants")
+			}
+		}
+	}
+}
+
+// Lookup returns the tenant of the schema. An unknown schema reloads the tenants, at most once a
+// minute, so a new tenant does not have to wait for the next refresh.
+func (r *Registry) Lookup(ctx context.Context, schema string) (*Tenant, bool) {
+	if t, ok := r.get(schema); ok {
+		return t, true
+	}
+	if err := r.reloadStale(ctx); err != nil {
+		r.logger.WithError(err).Error("Unable to reload the tenants")
+	}
+	return r.get(schema)
+}
+
+// reloadStale reloads the tenants unless they were loaded, or a reload was tried, less than minReload ago.
+// The check is made under the loading lock, so the concurrent lookups of unknown schemas wait for a single
+// reload instead of running one each.
+func (r *Registry) reloadStale(ctx context.Context) error {
+	r.loading.Lock()
+	defer r.loading.Unlock()
+	r.mu.RLock()
+	stale := time.Since(r.loaded) > minReload
+	r.mu.RUnlock()
+	if !stale || time.Since(r.tried) <= minReload {
+		return nil
+	}
+	r.tried = time.Now()
+	return r.load(ctx)
+}
+
+// Schemas returns the schemas of the known tenants, sorted.
+func (r *Registry) Schemas() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	schemas := make([]string, 0, len(r.tenants))
+	for schema := range r.tenants {
+		schemas = append(schemas, schema)
+	}
+	sort.Strings(schemas)
+	return schemas
+}
+
+func (r *Registry) get(schema string) (*Tenant, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tenants[schema]
+	return t, ok
+}
+
+// Load reads the tenants from the database.
+func (r *Registry) Load(ctx context.Context) error {
+	r.loading.Lock()
+	defer r.loading.Unlock()
+	return r.load(ctx)
+}
+
+func (r *Registry) load(ctx context.Context) error {
+	q := "SELECT table_schema, table_schema FROM information_schema.tables WHERE table_name = 'auth_user'"
+	if r.table != "" {
+		q = fmt.Sprintf("SELECT schema_name, name FROM %s", pgx.Identifier(strings.Split(r.table, ".")).Sanitize())
+	}
+	res, err := r.conn.Query(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	tenants := map[string]*Tenant{}
+	for res.Next() {
+		t := &Tenant{Settings: DefaultSettings}
+		if err := res.Scan(&t.Schema, &t.Name); err != nil {
+			return err
+		}
+		tenants[t.Schema] = t
+	}
+	res.Close()
+	if err := res.Err(); err != nil {
+		return err
+	}
+	if err := r.loadSettings(ctx, tenants); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.tenants = tenants
+	r.loaded = time.Now()
+	r.mu.Unlock()
+	r.logger.WithField("tenants", len(tenants)).Debug("Tenants loaded")
+	return nil
+}
+
+// loadSettings reads the settings of the tenants which applied the tenant_setting migration, in one batch.
+func (r *Registry) loadSettings(ctx context.Context, tenants map[string]*Tenant) error {
+	res, err := r.conn.Query(ctx, "SELECT table_schema FROM information_schema.tables WHERE table_name = 'tenant_setting'")
+	if err != nil {
+		return err
+	}
+	var schemas []string
+	for res.Next() {
+		var schema string
+		if err := res.Scan(&schema); err != nil {
+			res.Close()
+			return err
+		}
+		if _, ok := tenants[schema]; ok {
+			schemas = append(schemas, schema)
+		}
+	}
+	res.Close()
+	if err := res.Err(); err != nil {
+		return err
+	}
+	if len(schemas) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, schema := range schemas {
+		batch.Queue(fmt.Sprintf("SELECT timezone, locale, date_format, week_start FROM %s",
+			pgx.Identifier{schema, "tenant_setting"}.Sanitize()))
+	}
+	br := r.conn.SendBatch(ctx, batch)
+	defer br.Close()
+	for _, schema := range schemas {
+		var (
+			timezone, locale, dateFormat string
+			weekStart                    int16
+		)
+		err := br.QueryRow().Scan(&timezone, &locale, &dateFormat, &weekStart)
+		switch err {
+		case nil:
+		case pgx.ErrNoRows:
+			continue
+		default:
+			return err
+		}
+		s, err := NewSettings(timezone, locale, dateFormat, time.Weekday(weekStart))
+		if err != nil {
+			r.logger.WithError(err).WithField("schema", schema).Warn("Invalid tenant settings, using the defaults")
+			continue
+		}
+		tenants[schema].Settings = s
+	}
+	return nil
+}
+
+// FromContext returns the tenant set by the auth middleware, nil if the request is not authenticated.
+func FromContext(c *gin.Context) *Tenant {
+	t, _ := c.Value(utils.CtxTenant).(*Tenant)
+	return t
+}
@@ -0,0 +1,158 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Querier is the part of pgxpool.Pool used by the controllers.
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Begin(ctx context.Context) (pgx.Tx, error)
+	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
+}
+
+// WrapDB returns a Querier creating a span for every query, including the ones of the transactions.
+// The span of a query returning rows ends when the rows are read or closed.
+func WrapDB(db Querier) Querier {
+	return &tracedDB{db: db}
+}
+
+type tracedDB struct {
+	db Querier
+}
+
+func (d *tracedDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return query(ctx, d.db.Query, sql, args)
+}
+
+func (d *tracedDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return queryRow(ctx, d.db.QueryRow, sql, args)
+}
+
+func (d *tracedDB) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return exec(ctx, d.db.Exec, sql, args)
+}
+
+func (d *tracedDB) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedTx{Tx: tx}, nil
+}
+
+func (d *tracedDB) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	tx, err := d.db.BeginTx(ctx, txOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedTx{Tx: tx}, nil
+}
+
+// tracedTx traces the queries of a transaction, the other methods are the ones of the transaction.
+type tracedTx struct {
+	pgx.Tx
+}
+
+func (t *tracedTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return query(ctx, t.Tx.Query, sql, args)
+}
+
+func (t *tracedTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return queryRow(ctx, t.Tx.QueryRow, sql, args)
+}
+
+func (t *tracedTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return exec(ctx, t.Tx.Exec, sql, args)
+}
+
+func query(ctx context.Context, fn func(context.Context, string, ...interface{}) (pgx.Rows, error), sql string,
+	args []interface{}) (pgx.Rows, error) {
+	ctx, span := startQuery(ctx, sql)
+	rows, err := fn(ctx, sql, args...)
+	if err != nil {
+		endQuery(span, err)
+		return rows, err
+	}
+	return &tracedRows{Rows: rows, span: span}, nil
+}
+
+func queryRow(ctx context.Context, fn func(context.Context, string, ...interface{}) pgx.Row, sql string,
+	args []interface{}) pgx.Row {
+	ctx, span := startQuery(ctx, sql)
+	return &tracedRow{row: fn(ctx, sql, args...), span: span}
+}
+
+func exec(ctx context.Context, fn func(context.Context, string, ...interface{}) (pgconn.CommandTag, error),
+	sql string, args []interface{}) (pgconn.CommandTag, error) {
+	ctx, span := startQuery(ctx, sql)
+	tag, err := fn(ctx, sql, args...)
+	endQuery(span, err)
+	return tag, err
+}
+
+// startQuery starts the span of a query, it is named after the SQL command, e.g. "SELECT".
+func startQuery(ctx context.Context, sql string) (context.Context, trace.Span) {
+	name := "query"
+	if fields := strings.Fields(sql); len(fields) > 0 {
+		name = strings.ToUpper(fields[0])
+	}
+	return Tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBStatement(sql)))
+}
+
+// endQuery ends the span of a query, no rows is not an error.
+func endQuery(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedRow ends the span when the row is scanned.
+type tracedRow struct {
+	row  pgx.Row
+	span trace.Span
+}
+
+func (r *tracedRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	endQuery(r.span, err)
+	return err
+}
+
+// tracedRows ends the span when every row was read or the rows are closed.
+type tracedRows struct {
+	pgx.Rows
+	span trace.Span
+	once sync.Once
+}
+
+func (r *tracedRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.end()
+	return false
+}
+
+func (r *tracedRows) Close() {
+	r.Rows.Close()
+	r.end()
+}
+
+func (r *tracedRows) end() {
+	r.once.Do(func() { endQuery(r.span, r.Rows.Err()) })
+}
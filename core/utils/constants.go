@@ -1,6 +1,18 @@
 package utils
 
 const (
-	CtxSchema = "ctx-schema"
+	// CtxTenant holds the *tenant.Tenant of the request.
+	CtxTenant = "ctx-tenant"
 	CtxUserID = "ctx-user-id"
+	CtxRoles  = "ctx-user-roles"
+	// CtxTokenID and CtxTokenExpiry identify the access token of the request, so it can be revoked.
+	CtxTokenID     = "ctx-token-id"
+	CtxTokenExpiry = "ctx-token-expiry"
+	// CtxScopes holds the permissions of the API key of the request, it is unset for the JWT.
+	CtxScopes = "ctx-api-key-scopes"
+)
+
+const (
+	// RoleAdmin is the JWT role allowed to act on the data of every user of the tenant.
+	RoleAdmin = "admin"
 )
@@ -14,6 +14,30 @@ var ErrPageLimitExceeded = errors.New("maximum page limit exceeded")
 // ErrRouteAlreadyLinked is used for returning custom error messages if the route already linked to the other Fe.
 var ErrRouteAlreadyLinked = errors.New("route is already linked with other FieldExecutive")
 
+// ErrReportTypeNotFound is used for returning custom error messages if the requested report type does not exist.
+var ErrReportTypeNotFound = errors.New("report type does not exist")
+
+// ErrReportNotReady is used for returning custom error messages if the report file is not generated yet.
+var ErrReportNotReady = errors.New("report is not ready for download")
+
+// ErrInvalidReportStatus is used for returning custom error messages if the report status does not allow the operation.
+var ErrInvalidReportStatus = errors.New("operation is not allowed in the current report status")
+
+// ErrReportStopping is used for returning custom error messages if the cancelled run of a report is still stopping.
+var ErrReportStopping = errors.New("the previous report run is still stopping, retry later")
+
+// ErrInvalidCredentials is used for returning custom error messages if the username or password is wrong.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// ErrInvalidToken is used for returning custom error messages if a token is expired, revoked or of the wrong type.
+var ErrInvalidToken = errors.New("invalid or revoked token")
+
+// ErrInvalidSchedule is used for returning custom error messages if the cron, timezone or window of a schedule is not valid.
+var ErrInvalidSchedule = errors.New("invalid report schedule")
+
+// ErrInvalidAPIKey is used for returning custom error messages if an API key is unknown, expired or revoked.
+var ErrInvalidAPIKey = errors.New("invalid, expired or revoked API key")
+
 const (
 
 	// ErrCodeDataNotFound indicates the data is not found.
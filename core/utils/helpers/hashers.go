@@ -1,18 +1,25 @@
 package helpers
 
 import (
+	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"math"
-	"math/rand"
+	"math/big"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	b64 "encoding/base64"
 	"encoding/json"
 
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/pbkdf2"
 )
 
@@ -24,6 +31,11 @@ const (
 	iterations                      = 260000
 	digest                          = "sha256"
 	saltEntropy                     = 128
+	argon2TimeCost                  = 2
+	argon2MemoryCost                = 102400
+	argon2Parallelism               = 8
+	argon2HashLength                = 32
+	bcryptRounds                    = 12
 )
 
 var letterRunes = []rune(RANDOM_STRING_CHARS)
@@ -35,21 +47,126 @@ var letterRunes = []rune(RANDOM_STRING_CHARS)
 //   - length: 12, bit length =~ 71 bits
 //   - length: 22, bit length =~ 131 bits
 func GetRandomString(length int) string {
-	rand.Seed(time.Now().UnixNano())
+	max := big.NewInt(int64(len(letterRunes)))
 	b := make([]rune, length)
 	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			// The salts and secrets can not fall back to a predictable source.
+			panic(fmt.Sprintf("crypto/rand is unavailable: %v", err))
+		}
+		b[i] = letterRunes[n.Int64()]
 	}
 	return string(b)
 }
 
-// IsPasswordUsable return True if this password wasn't generated by
+// PasswordHasher is a Django compatible password hasher, the algorithm prefix of the encoded
+// password selects the hasher verifying it.
+type PasswordHasher interface {
+	// Algorithm is the prefix of the passwords encoded by the hasher.
+	Algorithm() string
+	Salt() string
+	Encode(password string, salt string) (string, error)
+	Verify(password, encoded string) bool
+	// SafeSummary describes the encoded password with the salt and hash masked.
+	SafeSummary(encoded string) ([]byte, error)
+	// MustUpdate returns true if the password was encoded with a lower work factor than the current one.
+	MustUpdate(encoded string) bool
+	// HardenRuntime spends the time missing from an older work factor, so a wrong password takes
+	// as long to reject as it takes to verify with the current one.
+	HardenRuntime(password, encoded string)
+}
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = map[string]PasswordHasher{}
+	preferred PasswordHasher
+)
+
+func init() {
+	for _, h := range []PasswordHasher{
+		&PBKDF2PasswordHasher{},
+		&PBKDF2PasswordHasher{Name: "pbkdf2_sha1", Digest: sha1.New},
+		&Argon2PasswordHasher{},
+		&BCryptSHA256PasswordHasher{},
+	} {
+		RegisterHasher(h)
+	}
+	preferred = hashers[algorithm]
+}
+
+// RegisterHasher adds the hasher to the registry, replacing the hasher of the same algorithm.
+func RegisterHasher(h PasswordHasher) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	hashers[h.Algorithm()] = h
+}
+
+// GetHasher returns the hasher of the algorithm.
+func GetHasher(algorithm string) (PasswordHasher, error) {
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+	h, ok := hashers[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown password hashing algorithm %q", algorithm)
+	}
+	return h, nil
+}
+
+// SetPreferredHasher selects the hasher encoding the new passwords, the passwords of the other
+// algorithms are upgraded on login.
+func SetPreferredHasher(algorithm string) error {
+	h, err := GetHasher(algorithm)
+	if err != nil {
+		return err
+	}
+	hashersMu.Lock()
+	preferred = h
+	hashersMu.Unlock()
+	return nil
+}
+
+// PreferredHasher returns the hasher encoding the new passwords.
+func PreferredHasher() PasswordHasher {
+	hashersMu.RLock()
+	defer hashersMu.RUnlock()
+	return preferred
+}
+
+// IdentifyHasher returns the hasher of the encoded password.
+func IdentifyHasher(encoded string) (PasswordHasher, error) {
+	name := strings.SplitN(encoded, "$", 2)[0]
+	return GetHasher(name)
+}
+
+// CheckPassword verifies the password against the encoded one. mustUpdate is true when the password
+// should be encoded again with the preferred hasher, it only matters when the password is correct.
+func CheckPassword(password, encoded string) (ok bool, mustUpdate bool) {
+	if password == "" || !IsPasswordUsable(encoded) {
+		return false, false
+	}
+	hasher, err := IdentifyHasher(encoded)
+	if err != nil {
+		return false, false
+	}
+	pref := PreferredHasher()
+	changed := hasher.Algorithm() != pref.Algorithm()
+	mustUpdate = changed || pref.MustUpdate(encoded)
+	ok = hasher.Verify(password, encoded)
+	// The runtime is only hardened for the same algorithm, as Django does.
+	if !ok && !changed && mustUpdate {
+		hasher.HardenRuntime(password, encoded)
+	}
+	return ok, mustUpdate
+}
+
+// IsPasswordUsable return False if this password was generated by
 // MakePassword(None).
 func IsPasswordUsable(encoded string) bool {
 	if encoded == "" {
 		return false
 	}
-	return strings.HasPrefix(encoded, UNUSABLE_PASSWORD_PREFIX)
+	return !strings.HasPrefix(encoded, UNUSABLE_PASSWORD_PREFIX)
 }
 
 // MakePassword Turn a plain-text password into a hash for database storage
@@ -62,16 +179,21 @@ func MakePassword(password string, salt string) (string, error) {
 	if password == "" {
 		return "", errors.New("password is not a valid password")
 	}
-	hasher := PBKDF2PasswordHasher{}
+	hasher := PreferredHasher()
 	if salt == "" {
 		salt = hasher.Salt()
 	}
 
-	return hasher.Encode(password, salt, iterations)
+	return hasher.Encode(password, salt)
 
 }
 
+// PBKDF2PasswordHasher is the pbkdf2_sha256 hasher of Django, the zero value uses the defaults.
+// Name and Digest select an other PBKDF2 variant, e.g. pbkdf2_sha1.
 type PBKDF2PasswordHasher struct {
+	Name       string
+	Digest     func() hash.Hash
+	Iterations int
 }
 
 type DecodePasswordHasher struct {
@@ -81,27 +203,54 @@ type DecodePasswordHasher struct {
 	Hash       string `json:"hash"`
 }
 
+func (h *PBKDF2PasswordHasher) Algorithm() string {
+	if h.Name == "" {
+		return algorithm
+	}
+	return h.Name
+}
+
+func (h *PBKDF2PasswordHasher) iterations() int {
+	if h.Iterations == 0 {
+		return iterations
+	}
+	return h.Iterations
+}
+
+func (h *PBKDF2PasswordHasher) digest() func() hash.Hash {
+	if h.Digest == nil {
+		return sha256.New
+	}
+	return h.Digest
+}
+
 // Salt generate a cryptographically secure nonce salt in ASCII with an entropy
 // of at least `salt_entropy` bits.
 func (h *PBKDF2PasswordHasher) Salt() string {
-	l := len(RANDOM_STRING_CHARS)
-	charCount := math.Ceil(saltEntropy / math.Log2(float64(l)))
-	return GetRandomString(int(charCount))
+	return randomSalt()
 }
 
-func (h *PBKDF2PasswordHasher) Encode(password string, salt string, iterations int) (string, error) {
+func (h *PBKDF2PasswordHasher) Encode(password string, salt string) (string, error) {
+	return h.encode(password, salt, h.iterations())
+}
+
+func (h *PBKDF2PasswordHasher) encode(password string, salt string, iterations int) (string, error) {
 	if password == "" {
 		return "", errors.New("password must not be empty")
 	}
 	if strings.Contains(salt, "$") {
 		return "", errors.New("salt shold not have character $")
 	}
-	hash := pbkdf2.Key([]byte(password), []byte(salt), iterations, sha256.Size, sha256.New)
-	return fmt.Sprintf("%s$%d$%s$%s", algorithm, iterations, salt, b64.StdEncoding.EncodeToString(hash)), nil
+	digest := h.digest()
+	hash := pbkdf2.Key([]byte(password), []byte(salt), iterations, digest().Size(), digest)
+	return fmt.Sprintf("%s$%d$%s$%s", h.Algorithm(), iterations, salt, b64.StdEncoding.EncodeToString(hash)), nil
 }
 
 func (h *PBKDF2PasswordHasher) Decode(encoded string) (DecodePasswordHasher, error) {
 	decodeArray := strings.Split(encoded, "$")
+	if len(decodeArray) != 4 || decodeArray[0] != h.Algorithm() {
+		return DecodePasswordHasher{}, errors.New("invalid encoded password")
+	}
 	algorithm, itr, salt, hash := decodeArray[0], decodeArray[1], decodeArray[2], decodeArray[3]
 	it, err := strconv.ParseInt(itr, 10, 64)
 	return DecodePasswordHasher{Algorithm: algorithm, Iterations: it, Salt: salt, Hash: hash}, err
@@ -109,33 +258,264 @@ func (h *PBKDF2PasswordHasher) Decode(encoded string) (DecodePasswordHasher, err
 
 func (h *PBKDF2PasswordHasher) Verify(password, encoded string) bool {
 	decoded, err := h.Decode(encoded)
-	if err != nil {
+	if err != nil || decoded.Iterations <= 0 {
 		return false
 	}
-	encoded_2, err := h.Encode(password, decoded.Salt, int(decoded.Iterations))
+	encoded_2, err := h.encode(password, decoded.Salt, int(decoded.Iterations))
 
 	if err != nil {
 		return false
 	}
-	return strings.Compare(encoded, encoded_2) == 0
+	return subtle.ConstantTimeCompare([]byte(encoded), []byte(encoded_2)) == 1
 }
 
 func (h *PBKDF2PasswordHasher) SafeSummary(encoded string) ([]byte, error) {
-	d, _ := h.Decode(encoded)
+	d, err := h.Decode(encoded)
+	if err != nil {
+		return nil, err
+	}
+	d.Salt, d.Hash = maskHash(d.Salt, 6), maskHash(d.Hash, 6)
 	return json.Marshal(d)
 }
 
 func (h *PBKDF2PasswordHasher) MustUpdate(encoded string) bool {
-
-	return false
+	decoded, err := h.Decode(encoded)
+	if err != nil {
+		return true
+	}
+	return decoded.Iterations < int64(h.iterations())
 }
 
-func (h *PBKDF2PasswordHasher) HardenRuntime(password, encoded string) (string, error) {
-	decoded, _ := h.Decode(encoded)
-	extra_iterations := iterations - decoded.Iterations
+func (h *PBKDF2PasswordHasher) HardenRuntime(password, encoded string) {
+	decoded, err := h.Decode(encoded)
+	if err != nil {
+		return
+	}
+	extra_iterations := int64(h.iterations()) - decoded.Iterations
 	if extra_iterations > 0 {
-		return h.Encode(password, decoded.Salt, int(extra_iterations))
+		h.encode(password, decoded.Salt, int(extra_iterations))
+	}
+}
+
+// Argon2PasswordHasher is the argon2 hasher of Django, only the argon2id variant is supported.
+// The zero value uses the Django defaults.
+type Argon2PasswordHasher struct {
+	TimeCost    uint32
+	MemoryCost  uint32
+	Parallelism uint8
+}
+
+type argon2Params struct {
+	Variant     string `json:"variant"`
+	Version     int    `json:"version"`
+	MemoryCost  uint32 `json:"memory_cost"`
+	TimeCost    uint32 `json:"time_cost"`
+	Parallelism uint8  `json:"parallelism"`
+	Salt        string `json:"salt"`
+	Hash        string `json:"hash"`
+}
+
+func (h *Argon2PasswordHasher) Algorithm() string {
+	return "argon2"
+}
+
+func (h *Argon2PasswordHasher) params() (t uint32, m uint32, p uint8) {
+	t, m, p = h.TimeCost, h.MemoryCost, h.Parallelism
+	if t == 0 {
+		t = argon2TimeCost
+	}
+	if m == 0 {
+		m = argon2MemoryCost
+	}
+	if p == 0 {
+		p = argon2Parallelism
+	}
+	return t, m, p
+}
+
+func (h *Argon2PasswordHasher) Salt() string {
+	return randomSalt()
+}
+
+// Encode returns argon2$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>, the salt and
+// hash are unpadded base64 as encoded by argon2-cffi.
+func (h *Argon2PasswordHasher) Encode(password string, salt string) (string, error) {
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+	t, m, p := h.params()
+	key := argon2.IDKey([]byte(password), []byte(salt), t, m, p, argon2HashLength)
+	return fmt.Sprintf("%s$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", h.Algorithm(), argon2.Version, m, t, p,
+		b64.RawStdEncoding.EncodeToString([]byte(salt)), b64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2PasswordHasher) decode(encoded string) (argon2Params, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != h.Algorithm() {
+		return argon2Params{}, errors.New("invalid encoded password")
 	}
+	d := argon2Params{Variant: parts[1], Salt: parts[4], Hash: parts[5]}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &d.Version); err != nil {
+		return argon2Params{}, err
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &d.MemoryCost, &d.TimeCost, &d.Parallelism); err != nil {
+		return argon2Params{}, err
+	}
+	return d, nil
+}
+
+func (h *Argon2PasswordHasher) Verify(password, encoded string) bool {
+	d, err := h.decode(encoded)
+	if err != nil || d.Variant != "argon2id" || d.Version != argon2.Version || d.TimeCost == 0 || d.Parallelism == 0 {
+		return false
+	}
+	salt, err := b64.RawStdEncoding.DecodeString(d.Salt)
+	if err != nil {
+		return false
+	}
+	want, err := b64.RawStdEncoding.DecodeString(d.Hash)
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), salt, d.TimeCost, d.MemoryCost, d.Parallelism, uint32(len(want)))
+	return subtle.ConstantTimeCompare(key, want) == 1
+}
+
+func (h *Argon2PasswordHasher) SafeSummary(encoded string) ([]byte, error) {
+	d, err := h.decode(encoded)
+	if err != nil {
+		return nil, err
+	}
+	d.Salt, d.Hash = maskHash(d.Salt, 6), maskHash(d.Hash, 6)
+	return json.Marshal(d)
+}
+
+func (h *Argon2PasswordHasher) MustUpdate(encoded string) bool {
+	d, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+	t, m, p := h.params()
+	return d.Variant != "argon2id" || d.Version != argon2.Version || d.TimeCost < t || d.MemoryCost < m ||
+		d.Parallelism != p
+}
+
+// HardenRuntime does nothing, the runtime of argon2 is too complicated to harden sensibly.
+func (h *Argon2PasswordHasher) HardenRuntime(password, encoded string) {}
+
+// BCryptSHA256PasswordHasher is the bcrypt_sha256 hasher of Django, the password is hashed with
+// SHA256 first so the bcrypt 72 bytes limit does not apply. The zero value uses 12 rounds.
+type BCryptSHA256PasswordHasher struct {
+	Rounds int
+}
+
+func (h *BCryptSHA256PasswordHasher) Algorithm() string {
+	return "bcrypt_sha256"
+}
+
+func (h *BCryptSHA256PasswordHasher) rounds() int {
+	if h.Rounds == 0 {
+		return bcryptRounds
+	}
+	return h.Rounds
+}
+
+// Salt returns an empty salt, bcrypt generates its own.
+func (h *BCryptSHA256PasswordHasher) Salt() string {
+	return ""
+}
+
+func (h *BCryptSHA256PasswordHasher) prehash(password string) []byte {
+	sum := sha256.Sum256([]byte(password))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// Encode ignores the salt, bcrypt generates its own.
+func (h *BCryptSHA256PasswordHasher) Encode(password string, salt string) (string, error) {
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+	data, err := bcrypt.GenerateFromPassword(h.prehash(password), h.rounds())
+	if err != nil {
+		return "", err
+	}
+	return h.Algorithm() + "$" + string(data), nil
+}
+
+func (h *BCryptSHA256PasswordHasher) decode(encoded string) ([]byte, error) {
+	parts := strings.SplitN(encoded, "$", 2)
+	if len(parts) != 2 || parts[0] != h.Algorithm() {
+		return nil, errors.New("invalid encoded password")
+	}
+	return []byte(parts[1]), nil
+}
+
+func (h *BCryptSHA256PasswordHasher) Verify(password, encoded string) bool {
+	data, err := h.decode(encoded)
+	if err != nil {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(data, h.prehash(password)) == nil
+}
+
+func (h *BCryptSHA256PasswordHasher) SafeSummary(encoded string) ([]byte, error) {
+	data, err := h.decode(encoded)
+	if err != nil {
+		return nil, err
+	}
+	cost, err := bcrypt.Cost(data)
+	if err != nil {
+		return nil, err
+	}
+	// The bcrypt hash is $2b$<cost>$ followed by 22 characters of salt and the checksum.
+	raw := string(data)
+	if len(raw) < 29 {
+		return nil, errors.New("invalid encoded password")
+	}
+	return json.Marshal(map[string]interface{}{
+		"algorithm":   h.Algorithm(),
+		"work_factor": cost,
+		"salt":        maskHash(raw[7:29], 6),
+		"checksum":    maskHash(raw[29:], 6),
+	})
+}
+
+func (h *BCryptSHA256PasswordHasher) MustUpdate(encoded string) bool {
+	data, err := h.decode(encoded)
+	if err != nil {
+		return true
+	}
+	cost, err := bcrypt.Cost(data)
+	return err != nil || cost < h.rounds()
+}
+
+// HardenRuntime hashes with every cost between the encoded and the current one, their sum is the
+// runtime difference.
+func (h *BCryptSHA256PasswordHasher) HardenRuntime(password, encoded string) {
+	data, err := h.decode(encoded)
+	if err != nil {
+		return
+	}
+	cost, err := bcrypt.Cost(data)
+	if err != nil {
+		return
+	}
+	for c := cost; c < h.rounds(); c++ {
+		bcrypt.GenerateFromPassword(h.prehash(password), c)
+	}
+}
 
-	return password, nil
+// randomSalt generate a nonce salt in ASCII with an entropy of at least `salt_entropy` bits.
+func randomSalt() string {
+	l := len(RANDOM_STRING_CHARS)
+	charCount := math.Ceil(saltEntropy / math.Log2(float64(l)))
+	return GetRandomString(int(charCount))
+}
+
+// maskHash returns the first show characters of the hash, the rest is masked with "*".
+func maskHash(hash string, show int) string {
+	if len(hash) <= show {
+		return strings.Repeat("*", len(hash))
+	}
+	return hash[:show] + strings.Repeat("*", len(hash)-show)
 }
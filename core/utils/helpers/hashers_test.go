@@ -0,0 +1,146 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+)
+
+// The pbkdf2 and argon2 hashes come from the Django test suite, the pbkdf2 ones were checked against
+// hashlib.pbkdf2_hmac, which Django uses. bcrypt salts are random so Django has no fixed bcrypt_sha256 vector,
+// these hashes are bcrypt of the hex SHA-256 of the password, as Django computes them, with the $2b$ prefix
+// written by the Python bcrypt package.
+const (
+	djangoPBKDF2SHA256 = "pbkdf2_sha256$260000$seasalt$YlZ2Vggtqdc61YjArZuoApoBh9JNGYoDRBUGu6tcJQo="
+	djangoPBKDF2SHA1   = "pbkdf2_sha1$260000$seasalt2$wAibXvW6jgvatCdONi6SMJ6q7mI="
+	djangoArgon2ID     = "argon2$argon2id$v=19$m=102400,t=2,p=8$Y041dExhNkljRUUy$TMa6A8fPJhCAUXRhJXCXdw"
+	bcryptSHA256       = "bcrypt_sha256$$2b$12$fn4aZeCeCe6Uj3IDYQTGCeb76A7lBo700aixmfciHHpbIa4H2TWOW"
+	// The older work factors, they are upgraded on login.
+	djangoPBKDF2SHA256Weak = "pbkdf2_sha256$1$seasalt$mJQ8D8xVBAKQGCo0t0n+NSPS2a0gQhVtjuC9LdL9WiM="
+	bcryptSHA256Weak       = "bcrypt_sha256$$2b$04$HqSxSmH4Nlbz2vnGUH6UYuZxrQR.FOpVe9aDd9W.4xMFehn71FbwC"
+)
+
+// withPreferredHasher selects the preferred hasher for the test.
+func withPreferredHasher(t *testing.T, algorithm string) {
+	t.Helper()
+	previous := PreferredHasher().Algorithm()
+	if err := SetPreferredHasher(algorithm); err != nil {
+		t.Fatalf("SetPreferredHasher(%q): %v", algorithm, err)
+	}
+	t.Cleanup(func() { SetPreferredHasher(previous) })
+}
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		preferred  string
+		password   string
+		encoded    string
+		ok         bool
+		mustUpdate bool
+	}{
+		{"pbkdf2_sha256", "pbkdf2_sha256", "lètmein", djangoPBKDF2SHA256, true, false},
+		{"pbkdf2_sha256 wrong password", "pbkdf2_sha256", "letmein", djangoPBKDF2SHA256, false, false},
+		{"pbkdf2_sha256 fewer iterations", "pbkdf2_sha256", "lètmein", djangoPBKDF2SHA256Weak, true, true},
+		{"pbkdf2_sha1", "pbkdf2_sha1", "lètmein", djangoPBKDF2SHA1, true, false},
+		{"pbkdf2_sha1 to pbkdf2_sha256", "pbkdf2_sha256", "lètmein", djangoPBKDF2SHA1, true, true},
+		{"argon2", "argon2", "secret", djangoArgon2ID, true, false},
+		{"argon2 wrong password", "argon2", "lètmein", djangoArgon2ID, false, false},
+		{"argon2 to pbkdf2_sha256", "pbkdf2_sha256", "secret", djangoArgon2ID, true, true},
+		{"bcrypt_sha256", "bcrypt_sha256", "lètmein", bcryptSHA256, true, false},
+		{"bcrypt_sha256 wrong password", "bcrypt_sha256", "letmein", bcryptSHA256, false, false},
+		{"bcrypt_sha256 fewer rounds", "bcrypt_sha256", "lètmein", bcryptSHA256Weak, true, true},
+		{"pbkdf2_sha256 to bcrypt_sha256", "bcrypt_sha256", "lètmein", djangoPBKDF2SHA256, true, true},
+		{"unusable password", "pbkdf2_sha256", "lètmein", "!" + djangoPBKDF2SHA256, false, false},
+		{"empty password", "pbkdf2_sha256", "", djangoPBKDF2SHA256, false, false},
+		{"empty encoded password", "pbkdf2_sha256", "lètmein", "", false, false},
+		{"unknown algorithm", "pbkdf2_sha256", "lètmein", "md5$seasalt$f5531bef9f3687d0ccf0f617f0e25573", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPreferredHasher(t, tt.preferred)
+			ok, mustUpdate := CheckPassword(tt.password, tt.encoded)
+			if ok != tt.ok {
+				t.Errorf("ok = %v, want %v", ok, tt.ok)
+			}
+			// mustUpdate is only acted on when the password is correct.
+			if ok && mustUpdate != tt.mustUpdate {
+				t.Errorf("mustUpdate = %v, want %v", mustUpdate, tt.mustUpdate)
+			}
+		})
+	}
+}
+
+func TestMakePassword(t *testing.T) {
+	withPreferredHasher(t, "pbkdf2_sha256")
+	encoded, err := MakePassword("lètmein", "seasalt")
+	if err != nil {
+		t.Fatalf("MakePassword: %v", err)
+	}
+	if encoded != djangoPBKDF2SHA256 {
+		t.Errorf("MakePassword = %q, want the Django hash %q", encoded, djangoPBKDF2SHA256)
+	}
+	if _, err := MakePassword("", ""); err == nil {
+		t.Error("MakePassword of an empty password succeeded")
+	}
+}
+
+func TestMakePasswordRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{"pbkdf2_sha256", "pbkdf2_sha1", "argon2", "bcrypt_sha256"} {
+		t.Run(algorithm, func(t *testing.T) {
+			withPreferredHasher(t, algorithm)
+			encoded, err := MakePassword("lètmein", "")
+			if err != nil {
+				t.Fatalf("MakePassword: %v", err)
+			}
+			if !strings.HasPrefix(encoded, algorithm+"$") {
+				t.Errorf("encoded = %q, want the %s prefix", encoded, algorithm)
+			}
+			again, err := MakePassword("lètmein", "")
+			if err != nil {
+				t.Fatalf("MakePassword: %v", err)
+			}
+			if again == encoded {
+				t.Error("two encodings share the same salt")
+			}
+			if ok, mustUpdate := CheckPassword("lètmein", encoded); !ok || mustUpdate {
+				t.Errorf("CheckPassword = %v, %v, want true, false", ok, mustUpdate)
+			}
+			if ok, _ := CheckPassword("letmein", encoded); ok {
+				t.Error("CheckPassword accepted a wrong password")
+			}
+		})
+	}
+}
+
+func TestIsPasswordUsable(t *testing.T) {
+	tests := []struct {
+		encoded string
+		want    bool
+	}{
+		{djangoPBKDF2SHA256, true},
+		{djangoArgon2ID, true},
+		{"!" + GetRandomString(UNUSABLE_PASSWORD_SUFFIX_LENGTH), false},
+		{"!", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsPasswordUsable(tt.encoded); got != tt.want {
+			t.Errorf("IsPasswordUsable(%q) = %v, want %v", tt.encoded, got, tt.want)
+		}
+	}
+}
+
+func TestGetRandomString(t *testing.T) {
+	s := GetRandomString(22)
+	if len(s) != 22 {
+		t.Fatalf("len = %d, want 22", len(s))
+	}
+	for _, c := range s {
+		if !strings.ContainsRune(RANDOM_STRING_CHARS, c) {
+			t.Errorf("unexpected character %q", c)
+		}
+	}
+	if GetRandomString(22) == s {
+		t.Error("two random strings are equal")
+	}
+}
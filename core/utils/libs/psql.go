@@ -35,7 +35,6 @@ func NewPostgreSQLConnection(ctx context.Context, logger *logrus.Logger, minPool
 		"user=%s password=%s host=%s port=%d dbname=%s",
 		conf.User, conf.Password, conf.Host, conf.Port, conf.Database,
 	)
-	fmt.Println(dsn)
 	ctx, cancel := context.WithTimeout(ctx, DatabaseConnectionTimeOut)
 	defer cancel()
 	connConfig, err := pgxpool.ParseConfig(dsn)
@@ -56,11 +55,10 @@ func NewPostgreSQLConnection(ctx context.Context, logger *logrus.Logger, minPool
 	connConfig.ConnConfig.PreferSimpleProtocol = true
 
 	//connConfig.ConnConfig.BuildStatementCache = nil
-	password := fmt.Sprintf("%s%s", strings.Repeat("*", len(conf.Password)-3), conf.Password[len(conf.Password)-3:])
 	logger.WithFields(logrus.Fields{
 		"Driver":      "PostgreSQL",
 		"User":        conf.User,
-		"Password":    password,
+		"Password":    maskPassword(conf.Password),
 		"Host":        conf.Host,
 		"Port":        conf.Port,
 		"Database":    conf.Database,
@@ -80,3 +78,11 @@ func NewPostgreSQLConnection(ctx context.Context, logger *logrus.Logger, minPool
 	}
 	return conn, nil
 }
+
+// maskPassword hides the password, only the last 3 characters are kept for debugging.
+func maskPassword(password string) string {
+	if len(password) <= 3 {
+		return strings.Repeat("*", len(password))
+	}
+	return fmt.Sprintf("%s%s", strings.Repeat("*", len(password)-3), password[len(password)-3:])
+}
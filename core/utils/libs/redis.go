@@ -1 +1,93 @@
 package libs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// RedisConnectionTimeOut is the default timeout for established connections.
+	RedisConnectionTimeOut = 1 * time.Second
+	// RedisIdleTimeOut closes the connections remaining idle for this duration.
+	RedisIdleTimeOut = 240 * time.Second
+)
+
+// RedisConfig set configuration
+type RedisConfig struct {
+	Host          string
+	Port          int
+	Password      string
+	Database      int
+	UseTLS        bool
+	TLSSkipVerify bool
+}
+
+// NewRedisPool create new Redis connection pool.
+func NewRedisPool(ctx context.Context, logger *logrus.Logger, maxIdle int,
+	maxActive int, conf *RedisConfig) (*redis.Pool, error) {
+
+	addr := fmt.Sprintf("%s:%d", conf.Host, conf.Port)
+	if maxIdle == 0 {
+		maxIdle = 1 // Default idle pool size is set to 1
+	}
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(RedisConnectionTimeOut),
+		redis.DialDatabase(conf.Database),
+		redis.DialUseTLS(conf.UseTLS),
+		redis.DialTLSSkipVerify(conf.TLSSkipVerify),
+	}
+	if conf.Password != "" {
+		options = append(options, redis.DialPassword(conf.Password))
+	}
+	pool := &redis.Pool{
+		MaxIdle:     maxIdle,
+		MaxActive:   maxActive,
+		IdleTimeout: RedisIdleTimeOut,
+		Wait:        maxActive > 0,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, options...)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+
+	logger.WithFields(logrus.Fields{
+		"Driver":    "Redis",
+		"Password":  maskPassword(conf.Password),
+		"Host":      conf.Host,
+		"Port":      conf.Port,
+		"Database":  conf.Database,
+		"TLS":       conf.UseTLS,
+		"maxIdle":   pool.MaxIdle,
+		"maxActive": pool.MaxActive,
+	}).Info("Redis Connection Information")
+
+	if err := PingRedis(ctx, pool); err != nil {
+		logger.WithError(err).Errorf("Unable to connection to redis: %v", err)
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// PingRedis checks the health of the redis pool.
+func PingRedis(ctx context.Context, pool *redis.Pool) error {
+	ctx, cancel := context.WithTimeout(ctx, RedisConnectionTimeOut)
+	defer cancel()
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("PING")
+	return err
+}
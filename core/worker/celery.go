@@ -0,0 +1,171 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/gocelery/gocelery"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// TaskGenerateReport is the celery task name used to generate a download_report row.
+// The Django side enqueues it with the args (schema, report_id) and optionally the request_id kwarg, the id of the
+// request queuing the report, which is logged by the job. gocelery only reads the celery message protocol v1, the
+// Python producers must publish with task_protocol=1 (CELERY_TASK_PROTOCOL = 1 in the Django settings), the
+// protocol v2 messages of the celery defaults are not understood.
+const TaskGenerateReport = "report.generate"
+
+// kwargRequestID is the kwarg of TaskGenerateReport carrying the request id.
+const kwargRequestID = "request_id"
+
+// errEmptyQueue is returned by the MemoryBroker when there is nothing to consume.
+var errEmptyQueue = errors.New("no celery message available")
+
+// CeleryQueue is a Queue publishing jobs as celery tasks.
+type CeleryQueue struct {
+	broker gocelery.CeleryBroker
+}
+
+// NewCeleryQueue creates a new celery backed Queue publishing to the broker.
+func NewCeleryQueue(broker gocelery.CeleryBroker) *CeleryQueue {
+	return &CeleryQueue{broker: broker}
+}
+
+// Enqueue publishes the job to the celery broker. The message is built here, gocelery does not publish the
+// args and the kwargs of a task together.
+func (q *CeleryQueue) Enqueue(ctx context.Context, job Job) error {
+	task := &gocelery.TaskMessage{ID: uuid.NewString(), Task: TaskGenerateReport,
+		Args: []interface{}{job.Schema, job.ReportID}, Kwargs: map[string]interface{}{}}
+	if job.RequestID != "" {
+		task.Kwargs[kwargRequestID] = job.RequestID
+	}
+	body, err := task.Encode()
+	if err != nil {
+		return err
+	}
+	return q.broker.SendCeleryMessage(newCeleryMessage(body))
+}
+
+// newCeleryMessage wraps the encoded task into a protocol v1 message, with the properties set by gocelery.
+func newCeleryMessage(body string) *gocelery.CeleryMessage {
+	return &gocelery.CeleryMessage{
+		Body:        body,
+		ContentType: "application/json",
+		Properties: gocelery.CeleryProperties{
+			BodyEncoding:  "base64",
+			CorrelationID: uuid.NewString(),
+			ReplyTo:       uuid.NewString(),
+			DeliveryInfo:  gocelery.CeleryDeliveryInfo{RoutingKey: "celery", Exchange: "celery"},
+			DeliveryMode:  2,
+			DeliveryTag:   uuid.NewString(),
+		},
+		ContentEncoding: "utf-8",
+	}
+}
+
+// NewCeleryClient creates a celery client consuming the tasks of the broker, it has to be used for the clients
+// running RegisterTasks.
+func NewCeleryClient(broker gocelery.CeleryBroker, backend gocelery.CeleryBackend, concurrency int) (*gocelery.CeleryClient, error) {
+	return gocelery.NewCeleryClient(kwargsBroker{broker}, backend, concurrency)
+}
+
+// kwargsBroker appends the request id kwarg of the report tasks to their args, an empty one when the task has
+// none. gocelery calls the task functions with the args only, and only when their number matches.
+type kwargsBroker struct {
+	gocelery.CeleryBroker
+}
+
+// GetTaskMessage pops the next task of the broker.
+func (b kwargsBroker) GetTaskMessage() (*gocelery.TaskMessage, error) {
+	task, err := b.CeleryBroker.GetTaskMessage()
+	if err != nil || task == nil || task.Task != TaskGenerateReport {
+		return task, err
+	}
+	requestID, _ := task.Kwargs[kwargRequestID].(string)
+	task.Args = append(task.Args, requestID)
+	return task, nil
+}
+
+// RegisterTasks registers the go task handlers on the celery client, created by NewCeleryClient.
+func RegisterTasks(ctx context.Context, client *gocelery.CeleryClient, logger *logrus.Logger, handler Handler) {
+	// gocelery calls the task with reflection, json numbers are only converted to int.
+	client.Register(TaskGenerateReport, func(schema string, reportID int, requestID string) string {
+		job := Job{ReportID: int64(reportID), Schema: schema, RequestID: requestID}
+		log := logger.WithFields(logrus.Fields{"task": TaskGenerateReport, "report_id": job.ReportID, "schema": job.Schema})
+		if requestID != "" {
+			log = log.WithField("request_id", requestID)
+		}
+		log.Debug("Processing report job")
+		if err := handler(ctx, job); err != nil {
+			log.WithError(err).Error("Report job failed")
+			return "failed"
+		}
+		return "completed"
+	})
+}
+
+// MemoryBroker is an in-memory celery broker and backend, it is meant for local runs
+// where Redis is not available.
+type MemoryBroker struct {
+	mu       sync.Mutex
+	messages [][]byte
+	results  map[string]*gocelery.ResultMessage
+}
+
+// NewMemoryBroker creates a new in-memory broker.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{results: map[string]*gocelery.ResultMessage{}}
+}
+
+// SendCeleryMessage stores the message, it is copied since gocelery reuses the message objects.
+func (b *MemoryBroker) SendCeleryMessage(message *gocelery.CeleryMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.messages = append(b.messages, body)
+	b.mu.Unlock()
+	return nil
+}
+
+// GetTaskMessage pops the oldest message, it does not block.
+func (b *MemoryBroker) GetTaskMessage() (*gocelery.TaskMessage, error) {
+	b.mu.Lock()
+	if len(b.messages) == 0 {
+		b.mu.Unlock()
+		return nil, errEmptyQueue
+	}
+	body := b.messages[0]
+	b.messages = b.messages[1:]
+	b.mu.Unlock()
+
+	message := gocelery.CeleryMessage{}
+	if err := json.Unmarshal(body, &message); err != nil {
+		return nil, err
+	}
+	return message.GetTaskMessage(), nil
+}
+
+// GetResult returns the stored result of the task.
+func (b *MemoryBroker) GetResult(taskID string) (*gocelery.ResultMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result, ok := b.results[taskID]
+	if !ok {
+		return nil, errors.New("result not available")
+	}
+	return result, nil
+}
+
+// SetResult stores a copy of the task result.
+func (b *MemoryBroker) SetResult(taskID string, result *gocelery.ResultMessage) error {
+	r := *result
+	b.mu.Lock()
+	b.results[taskID] = &r
+	b.mu.Unlock()
+	return nil
+}
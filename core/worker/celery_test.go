@@ -0,0 +1,132 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gocelery/gocelery"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestClient(t *testing.T) (*gocelery.CeleryClient, *MemoryBroker) {
+	t.Helper()
+	broker := NewMemoryBroker()
+	client, err := NewCeleryClient(broker, broker, 1)
+	if err != nil {
+		t.Fatalf("NewCeleryClient: %v", err)
+	}
+	return client, broker
+}
+
+func TestCeleryQueueMessage(t *testing.T) {
+	broker := NewMemoryBroker()
+	job := Job{ReportID: 42, Schema: "tenant_a", RequestID: "req-1"}
+	if err := NewCeleryQueue(broker).Enqueue(context.Background(), job); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	msg, err := broker.GetTaskMessage()
+	if err != nil {
+		t.Fatalf("GetTaskMessage: %v", err)
+	}
+	// The Django side publishes the same task, the name, the args and the kwargs are a contract.
+	if msg.Task != "report.generate" {
+		t.Errorf("task = %q, want %q", msg.Task, "report.generate")
+	}
+	if len(msg.Args) != 2 || msg.Args[0] != "tenant_a" || msg.Args[1] != float64(42) {
+		t.Errorf("args = %v, want [tenant_a 42]", msg.Args)
+	}
+	if len(msg.Kwargs) != 1 || msg.Kwargs["request_id"] != "req-1" {
+		t.Errorf("kwargs = %v, want map[request_id:req-1]", msg.Kwargs)
+	}
+	if _, err := broker.GetTaskMessage(); !errors.Is(err, errEmptyQueue) {
+		t.Errorf("second GetTaskMessage error = %v, want %v", err, errEmptyQueue)
+	}
+}
+
+func TestCeleryQueueRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		handlerErr error
+		want       string
+	}{
+		{name: "completed", want: "completed"},
+		{name: "failed", handlerErr: errors.New("boom"), want: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, broker := newTestClient(t)
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			jobs := make(chan Job, 1)
+			RegisterTasks(context.Background(), client, logger, func(ctx context.Context, job Job) error {
+				jobs <- job
+				return tt.handlerErr
+			})
+			client.StartWorker()
+			defer client.StopWorker()
+
+			// The result is read from the backend, so the message is published through Delay. It has no kwargs,
+			// as the messages of the Django producers not passing the request id.
+			result, err := client.Delay(TaskGenerateReport, "tenant_a", int64(42))
+			if err != nil {
+				t.Fatalf("Delay: %v", err)
+			}
+			select {
+			case job := <-jobs:
+				if job != (Job{ReportID: 42, Schema: "tenant_a"}) {
+					t.Errorf("job = %+v, want report 42 of tenant_a", job)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the job was not consumed")
+			}
+			got, err := result.Get(5 * time.Second)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("result = %v, want %q", got, tt.want)
+			}
+			if _, err := broker.GetTaskMessage(); !errors.Is(err, errEmptyQueue) {
+				t.Errorf("queue not drained: %v", err)
+			}
+		})
+	}
+}
+
+func TestCeleryQueueEnqueueConsumed(t *testing.T) {
+	client, broker := newTestClient(t)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	jobs := make(chan Job, 2)
+	RegisterTasks(context.Background(), client, logger, func(ctx context.Context, job Job) error {
+		jobs <- job
+		return nil
+	})
+	client.StartWorker()
+	defer client.StopWorker()
+
+	q := NewCeleryQueue(broker)
+	want := []Job{{ReportID: 1, Schema: "tenant_a", RequestID: "req-1"}, {ReportID: 2, Schema: "tenant_b"}}
+	for _, job := range want {
+		if err := q.Enqueue(context.Background(), job); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	got := map[Job]bool{}
+	for range want {
+		select {
+		case job := <-jobs:
+			got[job] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d jobs consumed", len(got), len(want))
+		}
+	}
+	for _, job := range want {
+		if !got[job] {
+			t.Errorf("job %+v was not consumed", job)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"context"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/sirupsen/logrus"
+)
+
+// Heartbeat refreshes the key every interval until the context is done, the key expires after three
+// missed beats. Every celery worker refreshes the same key, so it exists while one of them is running.
+func Heartbeat(ctx context.Context, pool *redis.Pool, logger *logrus.Logger, key string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	ttl := int((3 * interval).Seconds())
+	if ttl < 1 {
+		ttl = 1
+	}
+	for {
+		conn, err := pool.GetContext(ctx)
+		if err == nil {
+			_, err = conn.Do("SET", key, time.Now().Unix(), "EX", ttl)
+			conn.Close()
+		}
+		if err != nil && ctx.Err() == nil {
+			logger.WithError(err).Warn("Unable to refresh the worker heartbeat")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckHeartbeat returns ErrNoWorker when the heartbeat key of the workers expired.
+func CheckHeartbeat(ctx context.Context, pool *redis.Pool, key string) error {
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	exists, err := redis.Bool(conn.Do("EXISTS", key))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoWorker
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrQueueClosed is returned when a job is enqueued after the queue was stopped.
+var ErrQueueClosed = errors.New("report job queue is closed")
+
+// ErrNoWorker is returned by the health checks when no worker consumes the jobs.
+var ErrNoWorker = errors.New("no report worker is running")
+
+// Job is a report generation request handed over to a background worker.
+// The filter payload lives on the download_report row, so the job only carries
+// enough information to locate it.
+type Job struct {
+	ReportID int64  `json:"report_id"`
+	Schema   string `json:"schema"`
+	// RequestID is the id of the request queuing the report, the celery tasks carry it as a kwarg.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Handler executes a single job.
+type Handler func(ctx context.Context, job Job) error
+
+// Queue accepts report jobs for asynchronous processing.
+type Queue interface {
+	Enqueue(ctx context.Context, job Job) error
+}
+
+// Pool is an in-process Queue backed by a buffered channel and a fixed number of goroutines.
+type Pool struct {
+	jobs     chan Job
+	size     int
+	logger   *logrus.Logger
+	wg       sync.WaitGroup
+	quit     chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	// running is the number of worker goroutines started and not returned yet.
+	running int32
+}
+
+// NewPool creates a new in-process worker pool.
+func NewPool(logger *logrus.Logger, size int, buffer int) *Pool {
+	if size <= 0 {
+		size = 1 // Default pool size is set to 1
+	}
+	return &Pool{jobs: make(chan Job, buffer), size: size, logger: logger, quit: make(chan struct{}),
+		cancel: func() {}}
+}
+
+// Start launches the worker goroutines, each job is passed to the handler. The jobs are cancelled along
+// with the context, or by Shutdown when they outlast the grace period.
+func (p *Pool) Start(ctx context.Context, handler Handler) {
+	ctx, cancel := context.WithCancel(ctx)
+	p.mu.Lock()
+	p.cancel = cancel
+	p.mu.Unlock()
+	for i := 0; i < p.size; i++ {
+		p.wg.Add(1)
+		atomic.AddInt32(&p.running, 1)
+		go func(worker int) {
+			defer p.wg.Done()
+			defer atomic.AddInt32(&p.running, -1)
+			for {
+				select {
+				case <-p.quit:
+					return
+				case <-ctx.Done():
+					return
+				case job := <-p.jobs:
+					log := p.logger.WithFields(logrus.Fields{"worker": worker, "report_id": job.ReportID, "schema": job.Schema})
+					if p.stopping() {
+						// The report stays queued in the database, it is queued again on the next start.
+						log.Debug("Pool is shutting down, leaving the report job queued")
+						return
+					}
+					log.Debug("Processing report job")
+					if err := handler(ctx, job); err != nil {
+						log.WithError(err).Error("Report job failed")
+					}
+				}
+			}
+		}(i)
+	}
+}
+
+// Enqueue adds the job to the pool, it blocks if the buffer is full.
+func (p *Pool) Enqueue(ctx context.Context, job Job) error {
+	if p.stopping() {
+		return ErrQueueClosed
+	}
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-p.quit:
+		return ErrQueueClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops taking jobs and waits for the running ones until the context is done, the jobs still
+// running are then cancelled and waited for. The jobs left in the buffer stay queued in the database.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.quit) })
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		p.cancel()
+		p.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) stopping() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Check returns an error when the pool is stopped or none of its workers is running.
+func (p *Pool) Check(ctx context.Context) error {
+	if p.stopping() {
+		return ErrQueueClosed
+	}
+	if atomic.LoadInt32(&p.running) == 0 {
+		return ErrNoWorker
+	}
+	return nil
+}
+
+// Depth returns the number of jobs waiting for a worker.
+func (p *Pool) Depth() int {
+	return len(p.jobs)
+}
@@ -0,0 +1,9 @@
+-- Columns used by the report run pipeline, apply to every tenant schema:
+--   SET search_path TO <schema>;
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS user_id bigint;
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS request jsonb;
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS result jsonb;
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS row_count integer NOT NULL DEFAULT 0;
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS error_message text;
+
+CREATE INDEX IF NOT EXISTS download_report_user_id_idx ON download_report (user_id);
@@ -0,0 +1,5 @@
+-- Generated report file recorded against the run, apply to every tenant schema:
+--   SET search_path TO <schema>;
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS file_name varchar(255);
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS file_path text;
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS file_size bigint;
@@ -0,0 +1,11 @@
+-- Status history of the report runs, apply to every tenant schema:
+--   SET search_path TO <schema>;
+CREATE TABLE IF NOT EXISTS download_report_status (
+    id         bigserial PRIMARY KEY,
+    report_id  bigint      NOT NULL REFERENCES download_report (id) ON DELETE CASCADE,
+    status     varchar(32) NOT NULL,
+    message    text,
+    created    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS download_report_status_report_id_idx ON download_report_status (report_id);
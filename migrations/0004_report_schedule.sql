@@ -0,0 +1,22 @@
+-- Recurring report runs, apply to every tenant schema:
+--   SET search_path TO <schema>;
+CREATE TABLE IF NOT EXISTS report_schedule (
+    id             bigserial PRIMARY KEY,
+    user_id        bigint       NOT NULL,
+    name           varchar(255) NOT NULL,
+    report_type    varchar(255) NOT NULL,
+    cron           varchar(255) NOT NULL,
+    timezone       varchar(64)  NOT NULL DEFAULT 'UTC',
+    "window"       varchar(32)  NOT NULL DEFAULT '',
+    request        jsonb        NOT NULL DEFAULT '{}',
+    is_active      boolean      NOT NULL DEFAULT true,
+    next_run       timestamptz,
+    last_run       timestamptz,
+    last_report_id bigint,
+    last_error     text,
+    created        timestamptz  NOT NULL DEFAULT now(),
+    modified       timestamptz  NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS report_schedule_user_id_idx ON report_schedule (user_id);
+CREATE INDEX IF NOT EXISTS report_schedule_next_run_idx ON report_schedule (next_run) WHERE is_active;
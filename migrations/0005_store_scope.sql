@@ -0,0 +1,22 @@
+-- Store assignments restricting what the non admin users see, apply to every tenant schema:
+--   SET search_path TO <schema>;
+CREATE TABLE IF NOT EXISTS store_userstore (
+    user_id  bigint NOT NULL,
+    store_id bigint NOT NULL,
+    PRIMARY KEY (user_id, store_id)
+);
+
+CREATE TABLE IF NOT EXISTS store_userregion (
+    user_id   bigint NOT NULL,
+    region_id bigint NOT NULL,
+    PRIMARY KEY (user_id, region_id)
+);
+
+CREATE TABLE IF NOT EXISTS store_regionstore (
+    region_id bigint NOT NULL,
+    store_id  bigint NOT NULL,
+    PRIMARY KEY (region_id, store_id)
+);
+
+CREATE INDEX IF NOT EXISTS store_userstore_store_id_idx ON store_userstore (store_id);
+CREATE INDEX IF NOT EXISTS store_regionstore_store_id_idx ON store_regionstore (store_id);
@@ -0,0 +1,16 @@
+-- Revoked tokens, apply to every tenant schema:
+--   SET search_path TO <schema>;
+CREATE TABLE IF NOT EXISTS auth_revoked_token (
+    jti        varchar(64) PRIMARY KEY,
+    user_id    bigint      NOT NULL,
+    expires_at timestamptz NOT NULL,
+    created    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS auth_revoked_token_expires_at_idx ON auth_revoked_token (expires_at);
+
+-- The tokens of the user issued before revoked_before are rejected.
+CREATE TABLE IF NOT EXISTS auth_user_revocation (
+    user_id        bigint PRIMARY KEY,
+    revoked_before timestamptz NOT NULL
+);
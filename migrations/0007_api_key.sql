@@ -0,0 +1,17 @@
+-- API keys of the machine clients, apply to every tenant schema:
+--   SET search_path TO <schema>;
+CREATE TABLE IF NOT EXISTS auth_api_key (
+    id         bigserial PRIMARY KEY,
+    user_id    bigint       NOT NULL,
+    name       varchar(255) NOT NULL,
+    -- prefix identifies the key, the secret is only stored as a PBKDF2 hash.
+    prefix     varchar(16)  NOT NULL UNIQUE,
+    key_hash   varchar(255) NOT NULL,
+    scopes     jsonb        NOT NULL DEFAULT '[]',
+    expires_at timestamptz,
+    last_used  timestamptz,
+    revoked    timestamptz,
+    created    timestamptz  NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS auth_api_key_user_id_idx ON auth_api_key (user_id);
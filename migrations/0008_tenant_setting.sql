@@ -0,0 +1,14 @@
+-- Regional settings of the tenant, apply to every tenant schema:
+--   SET search_path TO <schema>;
+-- The table holds at most one row, the defaults apply without it.
+CREATE TABLE IF NOT EXISTS tenant_setting (
+    id          boolean      PRIMARY KEY DEFAULT true CHECK (id),
+    timezone    varchar(64)  NOT NULL DEFAULT 'UTC',
+    -- locale is a BCP 47 tag, e.g. de-DE, it selects the date format when date_format is empty.
+    locale      varchar(35)  NOT NULL DEFAULT '',
+    -- date_format is a Go time layout, e.g. 02/01/2006 15:04.
+    date_format varchar(64)  NOT NULL DEFAULT '',
+    -- week_start is the first day of the week, 0 is Sunday and 1 Monday.
+    week_start  smallint     NOT NULL DEFAULT 1 CHECK (week_start BETWEEN 0 AND 6),
+    modified    timestamptz  NOT NULL DEFAULT now()
+);
@@ -0,0 +1,6 @@
+-- Runs of the report by the workers, apply to every tenant schema:
+--   SET search_path TO <schema>;
+-- attempt is incremented by the worker starting a run, the updates of a run only apply to its own attempt.
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS attempt integer NOT NULL DEFAULT 0;
+-- heartbeat is refreshed by the worker while the run is going on, it is cleared once the run has stopped.
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS heartbeat timestamptz;
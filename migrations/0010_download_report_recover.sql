@@ -0,0 +1,5 @@
+-- Recovery of the abandoned runs, apply to every tenant schema:
+--   SET search_path TO <schema>;
+-- The runs started before the heartbeat existed get one, so they are queued again if nobody refreshes it.
+UPDATE download_report SET heartbeat = now() WHERE status = 'running' AND heartbeat IS NULL;
+CREATE INDEX IF NOT EXISTS download_report_heartbeat_idx ON download_report (heartbeat) WHERE heartbeat IS NOT NULL;
@@ -0,0 +1,4 @@
+-- Progress of the report runs, apply to every tenant schema:
+--   SET search_path TO <schema>;
+-- progress is the last completion percentage of the running attempt, it is published on the report events too.
+ALTER TABLE download_report ADD COLUMN IF NOT EXISTS progress smallint NOT NULL DEFAULT 0;
@@ -0,0 +1,151 @@
+package views
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/crazi-coder/report-service/controller"
+	"github.com/crazi-coder/report-service/core/middleware"
+	"github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type APIKeyView interface {
+	Register(ctx context.Context) error // register API key urls
+	List(ctx *gin.Context)
+	Create(ctx *gin.Context)
+	Revoke(ctx *gin.Context)
+}
+
+type apiKeyView struct {
+	controller controller.APIKeyController
+	routeGroup *gin.RouterGroup
+	logger     *logrus.Logger
+	auth       gin.HandlerFunc
+	policy     middleware.Policy
+}
+
+// NewAPIKeyView creates the API key view, auth is the middleware authenticating the requests.
+func NewAPIKeyView(controller controller.APIKeyController, routeGroup *gin.RouterGroup, logger *logrus.Logger,
+	auth gin.HandlerFunc, policy middleware.Policy) APIKeyView {
+	return &apiKeyView{controller: controller, routeGroup: routeGroup, logger: logger, auth: auth, policy: policy}
+}
+
+// Register registers a API endpoint
+func (a *apiKeyView) Register(ctx context.Context) error {
+	group := a.routeGroup.Group("/api-keys", a.auth, middleware.Localize())
+	registerRoutes(group, a.policy, []route{
+		{http.MethodGet, "", middleware.PermManageAPIKeys, a.List},
+		{http.MethodPost, "", middleware.PermManageAPIKeys, a.Create},
+		{http.MethodDelete, "/:id", middleware.PermManageAPIKeys, a.Revoke},
+	})
+	return nil
+}
+
+func (a *apiKeyView) validate(ctx *gin.Context) (requestContext, error) {
+	return newRequestContext(ctx, a.policy)
+}
+
+func (a *apiKeyView) List(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := a.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+	list, err := a.controller.APIKeys(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID)
+	if err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, list)
+}
+
+// Create creates an API key, the scopes must be permissions granted to the user creating it.
+func (a *apiKeyView) Create(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := a.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+	req := controller.APIKeyRequest{}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid payload", err))
+		return
+	}
+	if len(req.Scopes) == 0 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, controller.InvalidScopes,
+			errors.New("at least one scope is required")))
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !knownPermission(scope) || !middleware.Allowed(ctx, a.policy, middleware.Permission(scope)) {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, controller.InvalidScopes,
+				fmt.Errorf("scope %q is unknown or not granted", scope)))
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Wrong expiry date",
+			errors.New("expires_at is in the past")))
+		return
+	}
+
+	k, err := a.controller.CreateAPIKey(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, req)
+	if err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	ctx.Header("Cache-Control", "no-store")
+	ctx.AbortWithStatusJSON(http.StatusCreated, k)
+}
+
+func (a *apiKeyView) Revoke(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := a.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid API key id", err))
+		return
+	}
+	if err := a.controller.RevokeAPIKey(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, id); err != nil {
+		a.abort(ctx, err)
+		return
+	}
+	ctx.AbortWithStatus(http.StatusNoContent)
+}
+
+func (a *apiKeyView) abort(ctx *gin.Context, err error) {
+	resp := helpers.NewResponse()
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		ctx.AbortWithStatusJSON(http.StatusNotFound,
+			resp.Error(helpers.ErrCodeDataNotFound, controller.DataNotFound, err),
+		)
+	default:
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+		)
+		a.logger.WithContext(ctx.Request.Context()).WithError(err).Error("Error processing the API key")
+	}
+}
+
+func knownPermission(scope string) bool {
+	for _, perm := range middleware.Permissions {
+		if middleware.Permission(scope) == perm {
+			return true
+		}
+	}
+	return false
+}
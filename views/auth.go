@@ -0,0 +1,155 @@
+package views
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/crazi-coder/report-service/controller"
+	"github.com/crazi-coder/report-service/core/middleware"
+	"github.com/crazi-coder/report-service/core/tenant"
+	"github.com/crazi-coder/report-service/core/utils"
+	"github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type AuthView interface {
+	Register(ctx context.Context) error // register auth urls
+	Token(ctx *gin.Context)
+	Refresh(ctx *gin.Context)
+	Logout(ctx *gin.Context)
+	RevokeUser(ctx *gin.Context)
+}
+
+type authView struct {
+	controller controller.AuthController
+	routeGroup *gin.RouterGroup
+	logger     *logrus.Logger
+	auth       gin.HandlerFunc
+	policy     middleware.Policy
+}
+
+// NewAuthView creates the auth view, auth is the middleware authenticating the logout and revoke requests.
+func NewAuthView(controller controller.AuthController, routeGroup *gin.RouterGroup, logger *logrus.Logger,
+	auth gin.HandlerFunc, policy middleware.Policy) AuthView {
+	return &authView{controller: controller, routeGroup: routeGroup, logger: logger, auth: auth, policy: policy}
+}
+
+// Register registers a API endpoint
+func (a *authView) Register(ctx context.Context) error {
+	if a.controller.Issuing() {
+		a.routeGroup.POST("/token", a.Token)
+		a.routeGroup.POST("/refresh", a.Refresh)
+	}
+	a.routeGroup.POST("/logout", a.auth, a.Logout)
+	a.routeGroup.POST("/users/:id/revoke", a.auth, middleware.RequirePermission(a.policy, middleware.PermRevokeTokens),
+		a.RevokeUser)
+	return nil
+}
+
+// Token logs the user in and returns an access and refresh token pair.
+func (a *authView) Token(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	req := controller.TokenRequest{}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid payload", err))
+		return
+	}
+
+	t, err := a.controller.Token(ctx.Request.Context(), req.Tenant, req.Username, req.Password)
+	switch err {
+	case nil:
+		ctx.Header("Cache-Control", "no-store")
+		ctx.AbortWithStatusJSON(http.StatusOK, t)
+	case helpers.ErrInvalidCredentials:
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized,
+			resp.Error(helpers.ErrCodeUnauthorized, "Unauthorized", err),
+		)
+	default:
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+		)
+		a.logger.WithContext(ctx.Request.Context()).WithError(err).Error("Error issuing the token")
+	}
+}
+
+// Refresh rotates the refresh token and returns a new token pair.
+func (a *authView) Refresh(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	req := controller.RefreshRequest{}
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid payload", err))
+		return
+	}
+
+	t, err := a.controller.Refresh(ctx.Request.Context(), req.RefreshToken)
+	switch {
+	case err == nil:
+		ctx.Header("Cache-Control", "no-store")
+		ctx.AbortWithStatusJSON(http.StatusOK, t)
+	case errors.Is(err, helpers.ErrInvalidToken):
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized,
+			resp.Error(helpers.ErrCodeUnauthorized, "Unauthorized", err),
+		)
+	default:
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+		)
+		a.logger.WithContext(ctx.Request.Context()).WithError(err).Error("Error refreshing the token")
+	}
+}
+
+// Logout revokes the access token of the request, along with the refresh token given in the payload.
+func (a *authView) Logout(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	// API keys are revoked through their own endpoint.
+	if ctx.GetString(utils.CtxTokenID) == "" {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest,
+			resp.Error(helpers.ErrCodeStatusBadRequest, "Not authenticated by a token", helpers.ErrInvalidToken))
+		return
+	}
+	req := controller.RefreshRequest{}
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid payload", err))
+			return
+		}
+	}
+
+	err := a.controller.Logout(ctx.Request.Context(), tenant.FromContext(ctx).Schema, ctx.GetString(utils.CtxUserID),
+		ctx.GetString(utils.CtxTokenID), ctx.GetTime(utils.CtxTokenExpiry), req.RefreshToken)
+	switch {
+	case err == nil:
+		ctx.AbortWithStatus(http.StatusNoContent)
+	case errors.Is(err, helpers.ErrInvalidToken):
+		ctx.AbortWithStatusJSON(http.StatusBadRequest,
+			resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid refresh token", err),
+		)
+	default:
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+		)
+		a.logger.WithContext(ctx.Request.Context()).WithError(err).Error("Error revoking the token")
+	}
+}
+
+// RevokeUser revokes every token of a user of the tenant.
+func (a *authView) RevokeUser(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	userID, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid user id", err))
+		return
+	}
+	err = a.controller.RevokeUser(ctx.Request.Context(), tenant.FromContext(ctx).Schema, strconv.FormatInt(userID, 10))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+		)
+		a.logger.WithContext(ctx.Request.Context()).WithError(err).WithField("user_id", userID).Error("Error revoking the user tokens")
+		return
+	}
+	ctx.AbortWithStatus(http.StatusNoContent)
+}
@@ -0,0 +1,59 @@
+package views
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/crazi-coder/report-service/core/health"
+	"github.com/crazi-coder/report-service/core/ldflags"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type HealthView interface {
+	Register(ctx context.Context) error // register probe urls
+	Live(ctx *gin.Context)
+	Ready(ctx *gin.Context)
+	Version(ctx *gin.Context)
+}
+
+type healthView struct {
+	checker    *health.Checker
+	routeGroup *gin.RouterGroup
+	logger     *logrus.Logger
+}
+
+// NewHealthView creates the probe view, the routes are not authenticated.
+func NewHealthView(checker *health.Checker, routeGroup *gin.RouterGroup, logger *logrus.Logger) HealthView {
+	return &healthView{checker: checker, routeGroup: routeGroup, logger: logger}
+}
+
+// Register registers a API endpoint
+func (h *healthView) Register(ctx context.Context) error {
+	h.routeGroup.GET("/healthz", h.Live)
+	h.routeGroup.GET("/readyz", h.Ready)
+	h.routeGroup.GET("/version", h.Version)
+	return nil
+}
+
+// Live answers as long as the server handles requests, it does not check the dependencies so a
+// database outage does not restart every replica.
+func (h *healthView) Live(ctx *gin.Context) {
+	ctx.AbortWithStatusJSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Ready checks the dependencies needed to serve the requests.
+func (h *healthView) Ready(ctx *gin.Context) {
+	res, ready := h.checker.Run(ctx.Request.Context())
+	if !ready {
+		h.logger.WithContext(ctx.Request.Context()).WithField("checks", res.Checks).Warn("Service is not ready")
+		ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, res)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, res)
+}
+
+// Version returns the build information.
+func (h *healthView) Version(ctx *gin.Context) {
+	ctx.AbortWithStatusJSON(http.StatusOK, ldflags.BuildInfo())
+}
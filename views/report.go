@@ -2,12 +2,19 @@ package views
 
 import (
 	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/crazi-coder/report-service/controller"
+	"github.com/crazi-coder/report-service/core/middleware"
+	"github.com/crazi-coder/report-service/core/storage"
+	"github.com/crazi-coder/report-service/core/tenant"
 	"github.com/crazi-coder/report-service/core/utils"
 	"github.com/crazi-coder/report-service/core/utils/helpers"
 	"github.com/gin-gonic/gin"
@@ -15,15 +22,24 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// exportFlushSize is the number of CSV rows written before flushing the response.
+const exportFlushSize = 500
+
+// eventHeartbeat is the interval of the keep alive comments sent on idle event streams.
+const eventHeartbeat = 15 * time.Second
+
 type requestContext struct {
 	requestUserID int64
+	requestTenant *tenant.Tenant
 	requestSchema string
+	requestRoles  []string
 }
 
 type ReportView interface {
 	Register(ctx context.Context) error // register filter urls
 	PhotoType(ctx *gin.Context)
 	Download(ctx *gin.Context)
+	Run(ctx *gin.Context)
 	Store(ctx *gin.Context)
 	Category(ctx *gin.Context)
 	Users(ctx *gin.Context)
@@ -33,29 +49,72 @@ type reportView struct {
 	controller controller.ReportController
 	routeGroup *gin.RouterGroup
 	logger     *logrus.Logger
+	policy     middleware.Policy
+	// writeTimeout is the write timeout of the server, given again to every write of a streamed response.
+	writeTimeout time.Duration
 }
 
 func NewReportView(controller controller.ReportController,
-	routeGroup *gin.RouterGroup, logger *logrus.Logger) ReportView {
-	return &reportView{controller: controller, routeGroup: routeGroup, logger: logger}
+	routeGroup *gin.RouterGroup, logger *logrus.Logger, policy middleware.Policy, writeTimeout time.Duration) ReportView {
+	return &reportView{controller: controller, routeGroup: routeGroup, logger: logger, policy: policy,
+		writeTimeout: writeTimeout}
+}
+
+// route is an endpoint along with the permission required to call it.
+type route struct {
+	method     string
+	path       string
+	permission middleware.Permission
+	handler    gin.HandlerFunc
 }
 
 // Register registers a API endpoint
 func (r *reportView) Register(ctx context.Context) error {
-	r.routeGroup.GET("/photo-types", r.PhotoType)
-	r.routeGroup.GET("/stores", r.Store)
-	r.routeGroup.GET("/stores/channel", r.StoreBrand)
-	r.routeGroup.GET("/stores/brand", r.StoreBrand)
-	r.routeGroup.GET("/categories", r.Category)
-	r.routeGroup.GET("/users", r.Users)
-	r.routeGroup.GET("/photos/sessions", r.PhotoSession)
-	r.routeGroup.GET("/runs/downloads", r.Download)
+	routes := []route{
+		{http.MethodGet, "/photo-types", middleware.PermViewFilters, r.PhotoType},
+		{http.MethodGet, "/stores", middleware.PermViewFilters, r.Store},
+		{http.MethodGet, "/stores/channel", middleware.PermViewFilters, r.StoreBrand},
+		{http.MethodGet, "/stores/brand", middleware.PermViewFilters, r.StoreBrand},
+		{http.MethodGet, "/categories", middleware.PermViewFilters, r.Category},
+		{http.MethodGet, "/users", middleware.PermViewFilters, r.Users},
+		{http.MethodGet, "/photos/sessions", middleware.PermViewSessions, r.PhotoSession},
+		{http.MethodGet, "/photos/sessions/export.csv", middleware.PermExportSessions, r.ExportPhotoSession},
+		{http.MethodPost, "/runs", middleware.PermRunReports, r.Run},
+		{http.MethodGet, "/runs/downloads", middleware.PermViewDownloads, r.Download},
+		{http.MethodGet, "/runs/downloads/:id", middleware.PermViewDownloads, r.DownloadDetail},
+		{http.MethodPost, "/runs/downloads/:id/cancel", middleware.PermRunReports, r.CancelDownload},
+		{http.MethodPost, "/runs/downloads/:id/retry", middleware.PermRunReports, r.RetryDownload},
+		{http.MethodGet, "/runs/downloads/:id/file", middleware.PermViewDownloads, r.DownloadFile},
+		{http.MethodGet, "/runs/downloads/:id/events", middleware.PermViewDownloads, r.DownloadEvents},
+	}
+	registerRoutes(r.routeGroup, r.policy, routes)
 	return nil
 }
 
+// registerRoutes registers the routes behind their permission check.
+func registerRoutes(group *gin.RouterGroup, policy middleware.Policy, routes []route) {
+	for _, rt := range routes {
+		group.Handle(rt.method, rt.path, middleware.RequirePermission(policy, rt.permission), rt.handler)
+	}
+}
+
 func (r *reportView) validate(ctx *gin.Context) (requestContext, error) {
+	return newRequestContext(ctx, r.policy)
+}
+
+// newRequestContext reads the user and tenant set by the auth middleware, the request context is
+// marked for the users who can see every store.
+func newRequestContext(ctx *gin.Context, policy middleware.Policy) (requestContext, error) {
 	rCtx := requestContext{}
-	rCtx.requestSchema = ctx.Value(utils.CtxSchema).(string)
+	rCtx.requestTenant = tenant.FromContext(ctx)
+	if rCtx.requestTenant == nil {
+		return rCtx, errors.New("no tenant in the request context")
+	}
+	rCtx.requestSchema = rCtx.requestTenant.Schema
+	rCtx.requestRoles = ctx.GetStringSlice(utils.CtxRoles)
+	if middleware.Allowed(ctx, policy, middleware.PermViewAllStores) {
+		ctx.Request = ctx.Request.WithContext(controller.WithAllStores(ctx.Request.Context()))
+	}
 	u := ctx.Value(utils.CtxUserID).(string)
 
 	requestUserID, err := strconv.ParseInt(u, 10, 64)
@@ -84,12 +143,293 @@ func (r *reportView) Download(ctx *gin.Context) {
 		return
 	}
 
-	p, err := r.controller.Download(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, controller.Request{})
-	if err != nil {
+	filter := controller.DownloadFilter{
+		Status:     splitList(ctx.Query("status")),
+		ReportType: splitList(ctx.Query("report_type")),
+	}
+	// Only admins may look at the runs of the other users.
+	if userStr := ctx.Query("user_id"); userStr != "" {
+		filter.UserID, err = strconv.ParseInt(userStr, 10, 64)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid user id", err))
+			return
+		}
+		filter.AllUsers = true
+	}
+	if ctx.Query("scope") == "all" {
+		filter.AllUsers = true
+	}
+	if filter.AllUsers && !middleware.Allowed(ctx, r.policy, middleware.PermViewAllDownloads) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden,
+			resp.Error(helpers.ErrCodeUnauthorized, "Unauthorized", helpers.ErrUnAuthorized))
+		return
+	}
+	st := tenant.SettingsFrom(ctx.Request.Context())
+	if createdFrom := ctx.Query("created_from"); createdFrom != "" {
+		if filter.CreatedFrom, err = st.ParseTime(createdFrom, false); err != nil {
+			ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeStatusBadRequest, "Wrong from date", err))
+			return
+		}
+	}
+	if createdTo := ctx.Query("created_to"); createdTo != "" {
+		if filter.CreatedTo, err = st.ParseTime(createdTo, true); err != nil {
+			ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeStatusBadRequest, "Wrong to date", err))
+			return
+		}
+	}
+	if pageSize, err := strconv.ParseUint(ctx.DefaultQuery("page_size", "100"), 10, 64); err == nil {
+		filter.PageSize = uint(pageSize)
+	}
+	if pageNumber, err := strconv.ParseUint(ctx.DefaultQuery("page", "1"), 10, 64); err == nil {
+		filter.PageNumber = uint(pageNumber)
+	}
+
+	p, err := r.controller.Download(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, ctx.Request.RequestURI, filter)
+	switch err {
+	case nil:
+		ctx.AbortWithStatusJSON(http.StatusOK, p)
+	case helpers.ErrPageLimitExceeded:
+		ctx.AbortWithStatusJSON(http.StatusBadRequest,
+			resp.Error(helpers.ErrPageLimitExceededError, controller.InvalidPageNumber, err),
+		)
+	default:
 		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Process failed", err))
+		r.logger.WithContext(ctx.Request.Context()).WithError(err).Error("Error retrieving the report runs")
+	}
+}
+
+// splitList splits a comma separated query value, empty values are dropped.
+func splitList(value string) []string {
+	list := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func (r *reportView) DownloadDetail(ctx *gin.Context) {
+	r.downloadAction(ctx, r.controller.DownloadDetail)
+}
+
+func (r *reportView) CancelDownload(ctx *gin.Context) {
+	r.downloadAction(ctx, r.controller.CancelDownload)
+}
+
+func (r *reportView) RetryDownload(ctx *gin.Context) {
+	r.downloadAction(ctx, r.controller.RetryDownload)
+}
+
+// downloadAction runs an operation on the report run given in the path and renders the resulting run.
+func (r *reportView) downloadAction(ctx *gin.Context,
+	action func(ctx context.Context, schema string, userID int64, reportID int64) (*controller.DownloadDetail, error)) {
+
+	resp := helpers.NewResponse()
+	rCtx, err := r.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
 		return
 	}
-	ctx.AbortWithStatusJSON(http.StatusOK, p)
+	reportID, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid report id", err))
+		return
+	}
+
+	d, err := action(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, reportID)
+	switch err {
+	case nil:
+		ctx.AbortWithStatusJSON(http.StatusOK, d)
+	case pgx.ErrNoRows:
+		ctx.AbortWithStatusJSON(http.StatusNotFound,
+			resp.Error(helpers.ErrCodeDataNotFound, controller.DataNotFound, err),
+		)
+	case helpers.ErrInvalidReportStatus, helpers.ErrReportStopping:
+		ctx.AbortWithStatusJSON(http.StatusConflict,
+			resp.Error(helpers.ErrCodeStatusBadRequest, controller.InvalidReportStatus, err),
+		)
+	default:
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+		)
+		r.logger.WithContext(ctx.Request.Context()).WithError(err).WithField("report_id", reportID).Error("Error processing the report run")
+	}
+}
+
+// writeDeadline slides the write deadline of a streamed response, so the write timeout of the server bounds
+// each write instead of the whole response.
+type writeDeadline struct {
+	ctx     *gin.Context
+	logger  *logrus.Logger
+	timeout time.Duration
+	next    time.Time
+	failed  bool
+}
+
+func (r *reportView) writeDeadline(ctx *gin.Context) *writeDeadline {
+	return &writeDeadline{ctx: ctx, logger: r.logger, timeout: r.writeTimeout}
+}
+
+// extend pushes the deadline a write timeout away, at most every half timeout.
+func (d *writeDeadline) extend() {
+	now := time.Now()
+	if d.failed || now.Before(d.next) {
+		return
+	}
+	d.next = now.Add(d.timeout / 2)
+	if err := http.NewResponseController(d.ctx.Writer).SetWriteDeadline(now.Add(d.timeout)); err != nil {
+		d.failed = true
+		d.logger.WithContext(d.ctx.Request.Context()).WithError(err).Warn("Unable to extend the write deadline")
+	}
+}
+
+// deadlineReader extends the write deadline before each read of a streamed file.
+type deadlineReader struct {
+	io.Reader
+	deadline *writeDeadline
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	r.deadline.extend()
+	return r.Reader.Read(p)
+}
+
+// DownloadEvents streams the status and progress of the report run as Server-Sent Events,
+// the stream ends once the run is completed, failed or cancelled.
+func (r *reportView) DownloadEvents(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := r.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+	reportID, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid report id", err))
+		return
+	}
+
+	ch, err := r.controller.WatchDownload(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, reportID)
+	switch err {
+	case nil:
+	case pgx.ErrNoRows:
+		ctx.AbortWithStatusJSON(http.StatusNotFound,
+			resp.Error(helpers.ErrCodeDataNotFound, controller.DataNotFound, err),
+		)
+		return
+	default:
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+		)
+		r.logger.WithContext(ctx.Request.Context()).WithError(err).WithField("report_id", reportID).Error("Error watching the report run")
+		return
+	}
+
+	ticker := time.NewTicker(eventHeartbeat)
+	defer ticker.Stop()
+	deadline := r.writeDeadline(ctx)
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no") // Disable the proxy buffering of nginx.
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return false
+			}
+			deadline.extend()
+			ctx.SSEvent("status", e)
+			return true
+		case <-ticker.C:
+			deadline.extend()
+			_, err := io.WriteString(w, ": heartbeat\n\n")
+			return err == nil
+		}
+	})
+}
+
+// DownloadFile redirects to a signed URL of the report file, or streams it when the storage can not sign URLs.
+func (r *reportView) DownloadFile(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := r.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+	reportID, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid report id", err))
+		return
+	}
+
+	a, err := r.controller.DownloadArtifact(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, reportID)
+	switch err {
+	case nil:
+	case pgx.ErrNoRows, storage.ErrNotFound:
+		ctx.AbortWithStatusJSON(http.StatusNotFound,
+			resp.Error(helpers.ErrCodeDataNotFound, controller.DataNotFound, err),
+		)
+		return
+	case helpers.ErrReportNotReady:
+		ctx.AbortWithStatusJSON(http.StatusConflict,
+			resp.Error(helpers.ErrCodeStatusBadRequest, controller.ReportNotReady, err),
+		)
+		return
+	default:
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+		)
+		r.logger.WithContext(ctx.Request.Context()).WithError(err).Error("Error retrieving the report file")
+		return
+	}
+	if a.URL != "" {
+		ctx.Redirect(http.StatusFound, a.URL)
+		return
+	}
+	defer a.Body.Close()
+	body := deadlineReader{Reader: a.Body, deadline: r.writeDeadline(ctx)}
+	ctx.DataFromReader(http.StatusOK, a.Size, a.ContentType, body, map[string]string{
+		"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, a.FileName),
+	})
+}
+
+func (r *reportView) Run(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := r.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+
+	req := controller.RunRequest{}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid payload", err))
+		return
+	}
+	if req.ReportType == "" {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Expected to pass report type", nil))
+		return
+	}
+	if req.Request.Timezone != "" {
+		if _, err := time.LoadLocation(req.Request.Timezone); err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid timezone", err))
+			return
+		}
+	}
+	d, err := r.controller.Run(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, req.ReportType, req.Request)
+	switch err {
+	case nil:
+		ctx.AbortWithStatusJSON(http.StatusAccepted, d)
+	case helpers.ErrReportTypeNotFound:
+		ctx.AbortWithStatusJSON(http.StatusBadRequest,
+			resp.Error(helpers.ErrCodeDataNotFound, controller.DataNotFound, err),
+		)
+	default:
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+		)
+		r.logger.WithContext(ctx.Request.Context()).WithError(err).Error("Error starting the report run")
+	}
 }
 
 func (r *reportView) Store(ctx *gin.Context) {
@@ -192,14 +532,9 @@ func (r *reportView) Users(ctx *gin.Context) {
 	ctx.AbortWithStatusJSON(http.StatusOK, p)
 }
 
-func (r *reportView) PhotoSession(ctx *gin.Context) {
-	resp := helpers.NewResponse()
-	rCtx, err := r.validate(ctx)
-	if err != nil {
-		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
-		return
-	}
-
+// photoSessionRequest parses the photo session filters from the query string,
+// on failure the returned message describes the invalid filter.
+func (r *reportView) photoSessionRequest(ctx *gin.Context) (controller.Request, string, error) {
 	storeStr := ctx.Query("store_list")
 	storeBrandStr := ctx.Query("store_brand_list")
 	storeChannelStr := ctx.Query("store_channel_list")
@@ -220,22 +555,38 @@ func (r *reportView) PhotoSession(ctx *gin.Context) {
 	req.SetPageNumber(pageNumber)
 	req.SetPageSize(pageSize)
 
-	// Convert the string representation of timestamp to a date object
+	// Convert the string representation of timestamp to a date object, dates without an offset
+	// are in the timezone of the tenant.
+	st := tenant.SettingsFrom(ctx.Request.Context())
 	if visitedFrom != "" {
-		From, err := time.Parse(time.RFC3339, visitedFrom)
+		From, err := st.ParseTime(visitedFrom, false)
 		if err != nil {
-			ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeStatusBadRequest, "Wring from date", err))
-			return
+			return req, "Wring from date", err
 		}
-		req.VisitedFrom = From.UTC()
+		req.VisitedFrom = From
 	}
 	if visitedTo != "" {
-		To, err := time.Parse(time.RFC3339, visitedTo)
+		To, err := st.ParseTime(visitedTo, true)
 		if err != nil {
-			ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeStatusBadRequest, "Wring to date", err))
-			return
+			return req, "Wring to date", err
 		}
-		req.VisitedTo = To.UTC()
+		req.VisitedTo = To
+	}
+	return req, "", nil
+}
+
+func (r *reportView) PhotoSession(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := r.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+
+	req, msg, err := r.photoSessionRequest(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeStatusBadRequest, msg, err))
+		return
 	}
 	p, err := r.controller.PhotoSessions(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, ctx.Request.RequestURI, req)
 	switch err {
@@ -253,7 +604,82 @@ func (r *reportView) PhotoSession(ctx *gin.Context) {
 		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
 			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
 		)
-		r.logger.WithError(err).Error("Error retrieving Photo Session details")
+		r.logger.WithContext(ctx.Request.Context()).WithError(err).Error("Error retrieving Photo Session details")
 	}
 	return
 }
+
+// photoSessionCSVHeader is the header row of the photo session CSV export.
+var photoSessionCSVHeader = []string{
+	"session_id", "visited_on", "created_at", "store_id", "store", "user_id", "user",
+	"category_id", "category", "photo_count",
+}
+
+// ExportPhotoSession streams every photo session matching the filters as CSV.
+func (r *reportView) ExportPhotoSession(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := r.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+
+	req, msg, err := r.photoSessionRequest(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeStatusBadRequest, msg, err))
+		return
+	}
+
+	// The headers are only sent with the first row, so a failing query can still return a JSON error.
+	w := csv.NewWriter(ctx.Writer)
+	deadline := r.writeDeadline(ctx)
+	rows := 0
+	start := func() error {
+		filename := fmt.Sprintf("photo-sessions-%s.csv", time.Now().UTC().Format("20060102-150405"))
+		ctx.Header("Content-Type", "text/csv; charset=utf-8")
+		ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		ctx.Header("Cache-Control", "no-store")
+		ctx.Status(http.StatusOK)
+		return w.Write(photoSessionCSVHeader)
+	}
+	err = r.controller.ExportPhotoSessions(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, req,
+		func(p *controller.PhotoSession) error {
+			if rows == 0 {
+				if err := start(); err != nil {
+					return err
+				}
+			}
+			rows++
+			deadline.extend()
+			err := w.Write([]string{
+				p.ID, p.VisitedOn, p.CreatedAt, strconv.Itoa(p.Store.ID), p.Store.Name,
+				strconv.Itoa(p.PhotoTakenBy.ID), p.PhotoTakenBy.Name, strconv.Itoa(p.Category.ID),
+				p.Category.Name, strconv.Itoa(p.PhotoCount),
+			})
+			if err == nil && rows%exportFlushSize == 0 {
+				w.Flush()
+				err = w.Error()
+				ctx.Writer.Flush()
+			}
+			return err
+		})
+	if err == nil && rows == 0 {
+		err = start()
+	}
+	if err != nil {
+		r.logger.WithContext(ctx.Request.Context()).WithError(err).WithField("rows", rows).Error("Error exporting Photo Session details")
+		if rows == 0 && !ctx.Writer.Written() {
+			ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+				resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+			)
+			return
+		}
+		// The response is already streaming, the truncated file is the only signal left.
+		ctx.Abort()
+		return
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		r.logger.WithContext(ctx.Request.Context()).WithError(err).Error("Error exporting Photo Session details")
+	}
+}
@@ -0,0 +1,171 @@
+package views
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/crazi-coder/report-service/controller"
+	"github.com/crazi-coder/report-service/core/middleware"
+	"github.com/crazi-coder/report-service/core/utils/helpers"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/sirupsen/logrus"
+)
+
+type ScheduleView interface {
+	Register(ctx context.Context) error // register schedule urls
+	List(ctx *gin.Context)
+	Get(ctx *gin.Context)
+	Create(ctx *gin.Context)
+	Update(ctx *gin.Context)
+	Delete(ctx *gin.Context)
+}
+
+type scheduleView struct {
+	controller controller.ScheduleController
+	routeGroup *gin.RouterGroup
+	logger     *logrus.Logger
+	policy     middleware.Policy
+}
+
+func NewScheduleView(controller controller.ScheduleController,
+	routeGroup *gin.RouterGroup, logger *logrus.Logger, policy middleware.Policy) ScheduleView {
+	return &scheduleView{controller: controller, routeGroup: routeGroup, logger: logger, policy: policy}
+}
+
+// Register registers a API endpoint
+func (s *scheduleView) Register(ctx context.Context) error {
+	registerRoutes(s.routeGroup, s.policy, []route{
+		{http.MethodGet, "/schedules", middleware.PermManageSchedules, s.List},
+		{http.MethodPost, "/schedules", middleware.PermManageSchedules, s.Create},
+		{http.MethodGet, "/schedules/:id", middleware.PermManageSchedules, s.Get},
+		{http.MethodPut, "/schedules/:id", middleware.PermManageSchedules, s.Update},
+		{http.MethodDelete, "/schedules/:id", middleware.PermManageSchedules, s.Delete},
+	})
+	return nil
+}
+
+func (s *scheduleView) validate(ctx *gin.Context) (requestContext, error) {
+	return newRequestContext(ctx, s.policy)
+}
+
+func (s *scheduleView) List(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := s.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+	list, err := s.controller.Schedules(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID)
+	if err != nil {
+		s.abort(ctx, err)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, list)
+}
+
+func (s *scheduleView) Get(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := s.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid schedule id", err))
+		return
+	}
+	sc, err := s.controller.Schedule(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, id)
+	if err != nil {
+		s.abort(ctx, err)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, sc)
+}
+
+func (s *scheduleView) Create(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := s.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+	req := controller.ScheduleRequest{}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid payload", err))
+		return
+	}
+	sc, err := s.controller.CreateSchedule(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, req)
+	if err != nil {
+		s.abort(ctx, err)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusCreated, sc)
+}
+
+func (s *scheduleView) Update(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := s.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid schedule id", err))
+		return
+	}
+	req := controller.ScheduleRequest{}
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid payload", err))
+		return
+	}
+	sc, err := s.controller.UpdateSchedule(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, id, req)
+	if err != nil {
+		s.abort(ctx, err)
+		return
+	}
+	ctx.AbortWithStatusJSON(http.StatusOK, sc)
+}
+
+func (s *scheduleView) Delete(ctx *gin.Context) {
+	resp := helpers.NewResponse()
+	rCtx, err := s.validate(ctx)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed, resp.Error(helpers.ErrCodeServerError, "Unknown User", err))
+		return
+	}
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, resp.Error(helpers.ErrCodeStatusBadRequest, "Invalid schedule id", err))
+		return
+	}
+	if err := s.controller.DeleteSchedule(ctx.Request.Context(), rCtx.requestSchema, rCtx.requestUserID, id); err != nil {
+		s.abort(ctx, err)
+		return
+	}
+	ctx.AbortWithStatus(http.StatusNoContent)
+}
+
+// abort renders the controller error.
+func (s *scheduleView) abort(ctx *gin.Context, err error) {
+	resp := helpers.NewResponse()
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		ctx.AbortWithStatusJSON(http.StatusNotFound,
+			resp.Error(helpers.ErrCodeDataNotFound, controller.DataNotFound, err),
+		)
+	case errors.Is(err, helpers.ErrInvalidSchedule):
+		ctx.AbortWithStatusJSON(http.StatusBadRequest,
+			resp.Error(helpers.ErrCodeStatusBadRequest, controller.InvalidSchedule, err),
+		)
+	default:
+		ctx.AbortWithStatusJSON(http.StatusExpectationFailed,
+			resp.Error(helpers.ErrCodeServerError, controller.Unrecognized, err),
+		)
+		s.logger.WithContext(ctx.Request.Context()).WithError(err).Error("Error processing the report schedule")
+	}
+}